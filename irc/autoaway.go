@@ -0,0 +1,35 @@
+package irc
+
+import (
+	"time"
+)
+
+// markActive records outgoing activity for auto-away. It returns true if the
+// client was automatically marked away, in which case the caller must send an
+// AWAY to mark the client as back before its message.
+// This may be called from any goroutine.
+func (s *safeConnState) markActive() bool {
+	s.lastActive.Store(time.Now().UnixNano())
+	return s.autoAway.CompareAndSwap(true, false)
+}
+
+// checkIdle marks the client as away if it has been idle for at least the
+// auto-away period. It returns how long to wait before checking again.
+func (c *Conn) checkIdle() time.Duration {
+	if c.autoAwayAfter <= 0 {
+		return 0
+	}
+	if c.safeConnState.autoAway.Load() || c.IsAway() {
+		// either we're already auto-away, or the user set an away message
+		// themselves, which we mustn't clobber
+		return c.autoAwayAfter
+	}
+	idle := time.Since(time.Unix(0, c.safeConnState.lastActive.Load()))
+	if idle < c.autoAwayAfter {
+		return c.autoAwayAfter - idle
+	}
+	if c.safeConnState.autoAway.CompareAndSwap(false, true) {
+		c.send(composeAway(c.autoAwayMsg))
+	}
+	return c.autoAwayAfter
+}
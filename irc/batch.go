@@ -0,0 +1,70 @@
+package irc
+
+// Batch is a group of lines sent by the server between BATCH +ref and
+// BATCH -ref, using the IRCv3 batch capability.
+type Batch struct {
+	Ref    string
+	Type   string // e.g. "netsplit" or "chathistory"
+	Params []string
+	// Parent is the ref of the enclosing batch, if this batch is nested.
+	Parent string
+	// Lines contains every line tagged with this batch, in order. Lines of
+	// nested batches are only included in the nested Batch.
+	Lines []Line
+}
+
+// Batch returns the completed batch for a BATCH line.
+// The second return value is false if the line isn't a BATCH event.
+func (l *Line) Batch() (Batch, bool) {
+	batch, ok := l.data.(*Batch)
+	if !ok {
+		return Batch{}, false
+	}
+	return *batch, true
+}
+
+// BatchRef returns the ref of the batch the line belongs to, or "" if it
+// isn't part of a batch.
+func (l *Line) BatchRef() string {
+	return l.Tags["batch"]
+}
+
+// addToBatch records the line in its open batch, if any.
+func (c *Conn) addToBatch(line Line) {
+	if ref := line.BatchRef(); ref != "" {
+		if batch, ok := c.batches[ref]; ok {
+			batch.Lines = append(batch.Lines, line)
+		}
+	}
+}
+
+func h_BATCH(conn *Conn, line Line) {
+	// BATCH +<ref> <type> *<params>
+	// BATCH -<ref>
+	if len(line.Args) == 0 || len(line.Args[0]) < 2 {
+		return
+	}
+	ref := line.Args[0][1:]
+	switch line.Args[0][0] {
+	case '+':
+		if len(line.Args) < 2 {
+			return
+		}
+		if conn.batches == nil {
+			conn.batches = make(map[string]*Batch)
+		}
+		conn.batches[ref] = &Batch{
+			Ref:    ref,
+			Type:   line.Args[1],
+			Params: line.Args[2:],
+			Parent: line.BatchRef(),
+		}
+	case '-':
+		batch, ok := conn.batches[ref]
+		if !ok {
+			return
+		}
+		delete(conn.batches, ref)
+		conn.dispatchReply(BATCH, line, []string{batch.Type}, batch)
+	}
+}
@@ -0,0 +1,87 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	batches := make(chan Batch, 3)
+	s.conn.AddHandler(BATCH, func(_ *Conn, line Line) {
+		if batch, ok := line.Batch(); ok {
+			batches <- batch
+		}
+	})
+	privmsgs := make(chan string, 5)
+	s.conn.AddHandler("PRIVMSG", func(_ *Conn, line Line) { privmsgs <- line.Args[1] })
+	s.register()
+	s.send(":srv BATCH +outer chathistory #chan",
+		"@batch=outer :a!a@h PRIVMSG #chan :1",
+		"@batch=outer :srv BATCH +inner netsplit irc.a irc.b",
+		"@batch=inner :b!b@h QUIT :irc.a irc.b",
+		"@batch=inner :c!c@h QUIT :irc.a irc.b",
+		":srv BATCH -inner",
+		"@batch=outer :a!a@h PRIVMSG #chan :2",
+		":srv BATCH -outer",
+		// never ended
+		":srv BATCH +open chathistory #other",
+		"@batch=open :a!a@h PRIVMSG #other :3",
+		// not open
+		"@batch=unknown :a!a@h PRIVMSG #chan :4",
+		":srv BATCH -unknown")
+	s.sync()
+
+	inner := <-batches
+	if inner.Ref != "inner" || inner.Type != "netsplit" || inner.Parent != "outer" ||
+		!reflect.DeepEqual(inner.Params, []string{"irc.a", "irc.b"}) {
+		t.Errorf("inner batch = %+v", inner)
+	}
+	if raws := batchRaws(inner); !reflect.DeepEqual(raws, []string{
+		"@batch=inner :b!b@h QUIT :irc.a irc.b",
+		"@batch=inner :c!c@h QUIT :irc.a irc.b",
+	}) {
+		t.Errorf("inner batch lines = %q", raws)
+	}
+
+	outer := <-batches
+	if outer.Ref != "outer" || outer.Type != "chathistory" || outer.Parent != "" ||
+		!reflect.DeepEqual(outer.Params, []string{"#chan"}) {
+		t.Errorf("outer batch = %+v", outer)
+	}
+	// the nested batch's lines are only in the nested batch
+	if raws := batchRaws(outer); !reflect.DeepEqual(raws, []string{
+		"@batch=outer :a!a@h PRIVMSG #chan :1",
+		"@batch=outer :srv BATCH +inner netsplit irc.a irc.b",
+		"@batch=outer :a!a@h PRIVMSG #chan :2",
+	}) {
+		t.Errorf("outer batch lines = %q", raws)
+	}
+
+	select {
+	case batch := <-batches:
+		t.Errorf("unexpected batch %+v", batch)
+	default:
+	}
+	// the lines are dispatched as usual, whether or not the batch ends
+	for _, want := range []string{"1", "2", "3", "4"} {
+		if got := <-privmsgs; got != want {
+			t.Errorf("PRIVMSG %q, want %q", got, want)
+		}
+	}
+
+	// the open batch is still collecting lines
+	lines := make(chan int)
+	s.conn.Invoke(func(c *Conn) { lines <- len(c.batches["open"].Lines) })
+	if n := <-lines; n != 1 {
+		t.Errorf("open batch has %d lines, want 1", n)
+	}
+}
+
+func batchRaws(batch Batch) []string {
+	raws := make([]string, len(batch.Lines))
+	for i, line := range batch.Lines {
+		raws[i] = line.Raw
+	}
+	return raws
+}
@@ -0,0 +1,206 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+)
+
+// Capabilities returns the IRCv3 capabilities acknowledged by the server, in
+// sorted order.
+func (c *Conn) Capabilities() []string {
+	return c.safeConnState.copyCaps()
+}
+
+// HasCapability returns whether the server acknowledged the given IRCv3
+// capability.
+func (c *Conn) HasCapability(name string) bool {
+	// we're the only writer, so no lock is needed for reading
+	return c.safeConnState.caps[name]
+}
+
+func (s *safeConnState) copyCaps() []string {
+	s.RLock()
+	defer s.RUnlock()
+	caps := make([]string, 0, len(s.caps))
+	for name := range s.caps {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+func (s *safeConnState) hasCap(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.caps[name]
+}
+
+// setCaps enables or disables the given capabilities.
+func (s *safeConnState) setCaps(names []string, enabled bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.caps == nil {
+		s.caps = make(map[string]bool)
+	}
+	for _, name := range names {
+		if enabled {
+			s.caps[name] = true
+		} else {
+			delete(s.caps, name)
+		}
+	}
+}
+
+// wantCap adds the capability to those that will be requested.
+func (c *Conn) wantCap(name string) {
+	for _, want := range c.wantCaps {
+		if want == name {
+			return
+		}
+	}
+	// copy, so the caller's slice isn't modified
+	c.wantCaps = append(c.wantCaps[:len(c.wantCaps):len(c.wantCaps)], name)
+}
+
+// capStart begins capability negotiation. It must be sent before NICK/USER,
+// as the server holds registration until it receives CAP END.
+func (c *Conn) capStart() {
+	if len(c.wantCaps) == 0 {
+		return
+	}
+	c.capNegotiating = true
+	c.capAvailable = make(map[string]string)
+	c.Raw("CAP LS 302")
+}
+
+// capEnd finishes capability negotiation, allowing registration to proceed.
+func (c *Conn) capEnd() {
+	if c.capNegotiating {
+		c.capNegotiating = false
+		c.Raw("CAP END")
+	}
+}
+
+// capRequest sends a CAP REQ for each wanted capability in offered that
+// isn't already enabled. If there's nothing to request, negotiation is
+// finished.
+func (c *Conn) capRequest(offered map[string]string) {
+	var req []string
+	for _, name := range c.wantCaps {
+		if _, ok := offered[name]; ok && !c.HasCapability(name) {
+			req = append(req, name)
+		}
+	}
+	if len(req) == 0 {
+		c.capEnd()
+		return
+	}
+	c.capPending++
+	c.Raw("CAP REQ :" + strings.Join(req, " "))
+}
+
+// parseCapList splits a capability list into names and values.
+func parseCapList(list string) map[string]string {
+	caps := make(map[string]string)
+	for _, token := range strings.Fields(list) {
+		name, val := token, ""
+		if idx := strings.IndexByte(token, '='); idx != -1 {
+			name, val = token[:idx], token[idx+1:]
+		}
+		caps[name] = val
+	}
+	return caps
+}
+
+func h_CAP(conn *Conn, line Line) {
+	// CAP <nick> <subcommand> [*] :<params>
+	if len(line.Args) < 3 {
+		return
+	}
+	params := line.Args[len(line.Args)-1]
+	more := len(line.Args) > 3 && line.Args[2] == "*"
+	switch line.Args[1] {
+	case "LS":
+		if !conn.capNegotiating {
+			return
+		}
+		for name, val := range parseCapList(params) {
+			conn.capAvailable[name] = val
+		}
+		if !more {
+			conn.capRequest(conn.capAvailable)
+		}
+	case "ACK":
+		var enabled, disabled []string
+		for _, name := range strings.Fields(params) {
+			switch name[0] {
+			case '-':
+				disabled = append(disabled, name[1:])
+			case '~', '=':
+				// obsolete modifiers from the 3.1 draft
+				enabled = append(enabled, name[1:])
+			default:
+				enabled = append(enabled, name)
+			}
+		}
+		conn.safeConnState.setCaps(enabled, true)
+		conn.safeConnState.setCaps(disabled, false)
+		conn.capReplied()
+		if len(enabled) > 0 {
+			conn.dispatchReply(CAPCHANGE, line, append([]string{"ACK"}, enabled...), nil)
+		}
+		if len(disabled) > 0 {
+			conn.dispatchReply(CAPCHANGE, line, append([]string{"DEL"}, disabled...), nil)
+		}
+	case "NAK":
+		conn.capReplied()
+	case "NEW":
+		// cap-notify, which is implied by CAP LS 302
+		if conn.capAvailable == nil {
+			return
+		}
+		added := parseCapList(params)
+		names := make([]string, 0, len(added))
+		for name, val := range added {
+			conn.capAvailable[name] = val
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		conn.dispatchReply(CAPCHANGE, line, append([]string{"NEW"}, names...), nil)
+		if !conn.capNegotiating {
+			conn.capRequest(added)
+		}
+	case "DEL":
+		var removed []string
+		for _, name := range strings.Fields(params) {
+			delete(conn.capAvailable, name)
+			if conn.HasCapability(name) {
+				removed = append(removed, name)
+			}
+		}
+		if len(removed) > 0 {
+			conn.safeConnState.setCaps(removed, false)
+			conn.dispatchReply(CAPCHANGE, line, append([]string{"DEL"}, removed...), nil)
+		}
+	}
+}
+
+// capReplied is called when the server answers one of our CAP REQs.
+func (c *Conn) capReplied() {
+	if c.capPending > 0 {
+		c.capPending--
+	}
+	if c.capPending == 0 && !c.saslStart() {
+		c.capEnd()
+	}
+}
+
+// ERR_UNKNOWNCOMMAND
+func h_421(conn *Conn, line Line) {
+	// <me> <command> :Unknown command
+	if len(line.Args) > 1 && line.Args[1] == "CAP" {
+		// the server doesn't support capability negotiation, and won't be
+		// waiting for CAP END
+		conn.capNegotiating = false
+	}
+}
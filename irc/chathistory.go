@@ -0,0 +1,56 @@
+package irc
+
+import (
+	"strconv"
+	"time"
+)
+
+// HistoryTimestamp returns a CHATHISTORY reference to the given time.
+func HistoryTimestamp(t time.Time) string {
+	return "timestamp=" + t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// HistoryMsgID returns a CHATHISTORY reference to the message with the given
+// msgid tag.
+func HistoryMsgID(msgid string) string {
+	return "msgid=" + msgid
+}
+
+// The ChatHistory methods fetch the message backlog for a channel or nick,
+// using the IRCv3 chathistory extension, which the server usually advertises
+// as the draft/chathistory capability. Refs are made with HistoryTimestamp
+// or HistoryMsgID. At most limit messages are returned, and the server's
+// maximum is in the CHATHISTORY ISUPPORT token.
+//
+// The messages arrive as a batch of type "chathistory", and are dispatched
+// as normal with Line.BatchRef() set, and with Line.Time set from their
+// server-time tags. The BATCH event then delivers the whole batch.
+
+// ChatHistoryLatest fetches the latest messages, after ref if it's not "*".
+func (c *Conn) ChatHistoryLatest(target, ref string, limit int) {
+	c.send(composeChatHistory("LATEST", target, limit, ref))
+}
+
+// ChatHistoryBefore fetches the messages before ref.
+func (c *Conn) ChatHistoryBefore(target, ref string, limit int) {
+	c.send(composeChatHistory("BEFORE", target, limit, ref))
+}
+
+// ChatHistoryAfter fetches the messages after ref.
+func (c *Conn) ChatHistoryAfter(target, ref string, limit int) {
+	c.send(composeChatHistory("AFTER", target, limit, ref))
+}
+
+// ChatHistoryBetween fetches the messages between start and end, starting
+// from start, which may be after end.
+func (c *Conn) ChatHistoryBetween(target, start, end string, limit int) {
+	c.send(composeChatHistory("BETWEEN", target, limit, start, end))
+}
+
+func composeChatHistory(subcommand, target string, limit int, refs ...string) string {
+	line := "CHATHISTORY " + subcommand + " " + firstWord(target)
+	for _, ref := range refs {
+		line += " " + firstWord(ref)
+	}
+	return filterMessage(line + " " + strconv.Itoa(limit))
+}
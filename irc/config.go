@@ -2,9 +2,12 @@ package irc
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"github.com/kballard/gocallback/callback"
+	"golang.org/x/text/encoding"
 	"io"
 	"net"
 	"strconv"
@@ -15,22 +18,134 @@ import (
 // Config represents the configuration used to set up a server connection.
 // After being passed to Connect(), the Config object can be thrown away.
 type Config struct {
-	Host     string
-	Port     uint // if 0, 6667 is used, or 6697 if SSL
+	Host string
+	Port uint // if 0, 6667 is used, or 6697 if SSL
+	// Password is sent with PASS before anything else. It can be used
+	// together with SASL, e.g. for a bouncer's password. Whether the server
+	// accepts a client whose SASL authentication failed is up to the
+	// server.
 	Password string
 
 	SSL       bool // set to true to use SSL
 	SSLConfig *tls.Config
+	// StartTLS upgrades a plaintext connection to SSL with the STARTTLS
+	// command before logging in. If the server refuses, Connect() returns an
+	// error. Ignored if SSL is true.
+	StartTLS bool
 
 	Nick     string
 	User     string
-	RealName string
+	RealName string // may contain spaces
+
+	// The initial user modes requested in the USER line. By default the
+	// client asks to be +i.
+	Visible bool // set to true to not request +i
+	Wallops bool // set to true to request +w
 
 	Timeout time.Duration // timeout for the Connect. 0 means no timeout.
 
-	AllowFlood   bool          // set to true to disable flood protection
-	PingInterval time.Duration // defaults to 3 minutes, set to -1 to disable
+	// LocalAddr is the local address to connect from, such as a *net.TCPAddr
+	// with the IP of a vhost. If nil, one is chosen automatically.
+	LocalAddr net.Addr
+
+	// Encoding is the character encoding used by the server, such as
+	// charmap.ISO8859_1 from golang.org/x/text/encoding/charmap. Incoming
+	// lines are decoded from it and outgoing lines encoded to it, so handlers
+	// always see UTF-8. Characters that can't be encoded are replaced. If
+	// nil, the server is assumed to use UTF-8.
+	Encoding encoding.Encoding
+
+	AllowFlood bool // set to true to disable flood protection
+	// PriorityQuit sends QUIT ahead of any lines waiting for the flood
+	// protection, like PING and PONG always are, so quitting isn't delayed
+	// by a backlog. The waiting lines are then lost.
+	PriorityQuit bool
+	// MaxQueue limits the number of lines waiting to be written to the
+	// server, so a runaway sender can't exhaust memory. QueuePolicy decides
+	// what happens when the queue is full. PING, PONG, and priority QUITs are
+	// never limited, and are sent even while other senders wait.
+	// 0 means no limit.
+	MaxQueue    int
+	QueuePolicy QueuePolicy
+	// PingInterval is how often to PING the server. If a PING hasn't been
+	// answered by the time the next one is due, the connection is shut down
+	// and Conn.LastError() returns ErrPingTimeout.
+	// Defaults to 3 minutes, set to -1 to disable.
+	PingInterval time.Duration
+	// PingTimeout is how long to wait without receiving anything from the
+	// server before considering the connection dead. It should be longer
+	// than PingInterval, so our PINGs keep a healthy connection alive.
+	// When it expires, Conn.LastError() returns a net.Error whose Timeout()
+	// is true. 0 means no timeout.
+	PingTimeout time.Duration
+	// WriteTimeout is how long writing a line to the server may take. If the
+	// server stops reading, so the line can't be written in time, the
+	// connection is shut down and Conn.LastError() returns a net.Error whose
+	// Timeout() is true. 0 means no timeout.
+	WriteTimeout time.Duration
+
+	// Flood tunes the flood protection. If nil, DefaultFloodProfile is used.
+	// Ignored if AllowFlood is true.
+	Flood *FloodProfile
+
+	// AutoAway marks the client as away after this long without sending a
+	// PRIVMSG or ACTION, using AutoAwayMessage. The away is cleared with the
+	// next PRIVMSG or ACTION. An away set with Conn.Away() is left alone.
+	// 0 disables auto-away.
+	AutoAway        time.Duration
+	AutoAwayMessage string // defaults to "Idle"
+
+	// ConnectedAfterMOTD delays the CONNECTED event until the end of the
+	// MOTD (RPL_ENDOFMOTD or ERR_NOMOTD), rather than RPL_MYINFO, so that
+	// the ISUPPORT tokens are known by then.
+	ConnectedAfterMOTD bool
 
+	// TrackState enables tracking of the channels the client is in and
+	// their members. See Conn.Channel().
+	TrackState bool
+
+	// The replies DefaultCTCPHandler sends to CTCP VERSION, SOURCE, and
+	// USERINFO queries. CTCPVersion defaults to the library's name. SOURCE and
+	// USERINFO are not answered if empty. CLIENTINFO is answered with the
+	// supported CTCP commands.
+	CTCPVersion  string
+	CTCPSource   string
+	CTCPUserInfo string
+
+	// Capabilities lists the IRCv3 capabilities to request from the server.
+	// Only capabilities the server advertises are requested, including those
+	// it advertises later with cap-notify. If empty, no capability
+	// negotiation is performed.
+	Capabilities []string
+
+	// SASLMechanism enables SASL authentication during capability
+	// negotiation, before registration completes. SASLPlain authenticates
+	// with SASLUser and SASLPassword; SASLExternal uses the client
+	// certificate in SSLConfig. The sasl capability is requested
+	// automatically. If authentication fails, registration proceeds
+	// without it, and the ERR_SASLFAIL numeric can be handled to find out.
+	// If empty, SASL isn't used.
+	SASLMechanism string
+	SASLUser      string
+	SASLPassword  string
+
+	// OnConnect is called with the network connection as soon as it's
+	// established, after any TLS handshake, but before Init and before any
+	// login lines are sent. It's called synchronously, so login waits for it
+	// to return. This is the place to e.g. start an identd responder for the
+	// connection's ports. It's called again by SafeConn.Reconnect.
+	// Optional.
+	OnConnect func(net.Conn)
+	// OutboundFilter is called with every line before it's queued to be
+	// written to the server, and returns the line to write instead, or "" to
+	// drop it. It's called from a goroutine of its own, not the connection's
+	// goroutine. NUL, CR, and LF are removed from the result, but any other
+	// bytes are kept, even if they aren't valid UTF-8. Optional.
+	OutboundFilter func(line string) string
+	// InboundFilter is called on the connection's goroutine with every line
+	// received from the server, before it's parsed, and returns the line to
+	// parse instead, and whether to keep it at all. Optional.
+	InboundFilter func(raw string) (string, bool)
 	// Init is called immediately after the connection is established but
 	// before logging in. This is the right place to set up handlers.
 	// If Init is called, Connect() will not return an error.
@@ -46,10 +161,52 @@ type Config struct {
 	NickInUse func(oldnick string, errcode int) string
 }
 
+// FloodProfile configures the flood protection algorithm from Hybrid IRCd.
+// Every line sent accrues a penalty of Penalty plus PerByte for each byte.
+// Lines are sent immediately until the accrued penalty exceeds Burst, at
+// which point sending is delayed to keep the penalty within Burst.
+// The zero FloodProfile disables flood protection.
+type FloodProfile struct {
+	Penalty time.Duration
+	PerByte time.Duration
+	Burst   time.Duration
+}
+
+// QueuePolicy decides what happens to a line sent while the queue is full.
+// See Config.MaxQueue.
+type QueuePolicy int
+
+const (
+	// QueueBlock makes the sender wait until there's room. A SafeConn
+	// method that sends several lines waits until they all fit.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest discards the line that has waited the longest.
+	QueueDropOldest
+	// QueueDropNewest discards the line being sent. The SafeConn methods
+	// return false instead of sending it, and a method that sends several
+	// lines sends either all of them or none.
+	QueueDropNewest
+)
+
+// DefaultFloodProfile is the normal 2-second penalty, plus 1/120th of a second
+// per byte, with a 10-second burst window.
+var DefaultFloodProfile = FloodProfile{
+	Penalty: 2 * time.Second,
+	PerByte: time.Second / 120,
+	Burst:   10 * time.Second,
+}
+
 // Connect initiates a connection to an IRC server identified by the Config.
 // It returns once the connection has been established.
 // If a connection could not be established, an error is returned.
 func Connect(config Config) (SafeConn, error) {
+	return ConnectContext(context.Background(), config)
+}
+
+// ConnectContext is like Connect, but the given context can be used to cancel
+// the connection attempt. Once connected, cancelling the context shuts down
+// the connection.
+func ConnectContext(ctx context.Context, config Config) (SafeConn, error) {
 	if config.Init == nil {
 		return nil, errors.New("Config needs an Init function")
 	}
@@ -63,6 +220,30 @@ func Connect(config Config) (SafeConn, error) {
 		}
 	}
 	addr := net.JoinHostPort(config.Host, strconv.FormatUint(uint64(port), 10))
+	nc, err := dialServer(ctx, addr, config.LocalAddr, config.Timeout, config.SSL, config.StartTLS, config.SSLConfig)
+	if err != nil {
+		return nil, err
+	}
+	return startConn(ctx, nc, addr, config, nil), nil
+}
+
+// startConn sets up a Conn on an established connection, logs in, and starts
+// the main loop. If state is non-nil, this is a reconnection, and the state
+// is reused instead of calling config.Init.
+func startConn(ctx context.Context, nc net.Conn, addr string, config Config, state *safeConnState) SafeConn {
+	if config.OnConnect != nil {
+		config.OnConnect(nc)
+	}
+	reconnect := state != nil
+	if !reconnect {
+		state = &safeConnState{
+			server:   addr,
+			registry: callback.NewRegistry(callback.DispatchSerial),
+			ctx:      ctx,
+			config:   config,
+		}
+	}
+	state.reset()
 	writer, reader := make(chan string), make(chan string)
 	writeErr, readErr := make(chan error, 1), make(chan error, 1)
 	invoker := make(chan func(*Conn))
@@ -73,25 +254,59 @@ func Connect(config Config) (SafeConn, error) {
 		},
 		stateRegistry: callback.NewRegistry(callback.DispatchSerial),
 		nickInUse:     config.NickInUse,
+		wantCaps:      config.Capabilities,
+		saslMech:      strings.ToUpper(config.SASLMechanism),
+		saslUser:      config.SASLUser,
+		saslPassword:  config.SASLPassword,
+		trackState:    config.TrackState,
+		autoAwayAfter: config.AutoAway,
+		autoAwayMsg:   config.AutoAwayMessage,
+		inboundFilter: config.InboundFilter,
+		afterMOTD:     config.ConnectedAfterMOTD,
 		writer:        writer,
 		reader:        reader,
 		writeErr:      writeErr,
 		readErr:       readErr,
 		invoker:       invoker,
-		safeConnState: &safeConnState{
-			server:   addr,
-			registry: callback.NewRegistry(callback.DispatchSerial),
-		},
-	}
-	nc, err := dialServer(addr, config.Timeout, config.SSL, config.SSLConfig)
-	if err != nil {
-		return nil, err
+		safeConnState: state,
 	}
 	conn.netconn = nc
-	config.Init(conn)
+	conn.queued = state.queued
+	if conn.saslMech != "" {
+		conn.wantCap("sasl")
+	}
+	if conn.trackState {
+		// so member lists have every prefix, not just the highest
+		conn.wantCap("multi-prefix")
+		conn.channels = make(map[string]*Channel)
+	}
+	if conn.autoAwayMsg == "" {
+		conn.autoAwayMsg = "Idle"
+	}
+	conn.ctcpInfo = map[string]string{
+		"VERSION":  config.CTCPVersion,
+		"SOURCE":   config.CTCPSource,
+		"USERINFO": config.CTCPUserInfo,
+	}
+	if conn.ctcpInfo["VERSION"] == "" {
+		conn.ctcpInfo["VERSION"] = "go library kballard/goirc"
+	}
+	conn.safeConnState.lastActive.Store(time.Now().UnixNano())
+	if !reconnect {
+		config.Init(conn)
+	}
 	// set up the writer and reader before we call any callbacks
-	go connWriter(nc, writer, writeErr, config.AllowFlood)
-	go connReader(nc, reader, readErr)
+	var flood FloodProfile
+	if !config.AllowFlood {
+		if config.Flood != nil {
+			flood = *config.Flood
+		} else {
+			flood = DefaultFloodProfile
+		}
+	}
+	stats := &conn.safeConnState.stats
+	go connWriter(nc, writer, writeErr, flood, &config, conn.queued, stats)
+	go connReader(nc, reader, readErr, config.PingTimeout, stats, config.Encoding)
 	// also set up the invoker infinite queue
 	queue := make(chan func(*Conn))
 	go invokerQueue(invoker, queue)
@@ -99,6 +314,12 @@ func Connect(config Config) (SafeConn, error) {
 	conn.safeConnState.Lock()
 	conn.safeConnState.writer = conn.writer
 	conn.safeConnState.invoker = queue
+	conn.safeConnState.netconn = nc
+	if conn.safeConnState.closing {
+		// SafeConn.Close was called during a Reconnect, so shut down as
+		// soon as runLoop starts
+		nc.Close()
+	}
 	conn.safeConnState.Unlock()
 	// set up the pinger
 	if config.PingInterval >= 0 {
@@ -106,128 +327,351 @@ func Connect(config Config) (SafeConn, error) {
 		if delta == 0 {
 			delta = 3 * time.Minute
 		}
-		go pinger(conn.SafeConn(), delta)
+		go pinger(state, conn.SafeConn(), delta, state.closed)
 	}
 	// dispatch the INIT callback
-	conn.safeConnState.registry.Dispatch(INIT, conn)
+	conn.safeConnState.dispatch(INIT, conn)
 	// set up our state handlers
 	conn.setupStateHandlers()
 	// fire off the login lines
-	conn.logIn(config.RealName, config.Password)
+	var mode uint
+	if !config.Visible {
+		mode |= 8 // +i
+	}
+	if config.Wallops {
+		mode |= 4 // +w
+	}
+	conn.logIn(config.RealName, config.Password, mode)
+	// tie the connection lifetime to the context
+	if ctx.Done() != nil {
+		go watchContext(ctx, conn.SafeConn(), state.closed)
+	}
 	// and finally, start the main loop in a new goroutine
 	go conn.runLoop()
-	return conn.SafeConn(), nil
+	return conn.SafeConn()
 }
 
-func dialServer(addr string, timeout time.Duration, ssl bool, sslconfig *tls.Config) (net.Conn, error) {
-	var nc net.Conn
-	var err error
+func dialServer(ctx context.Context, addr string, localAddr net.Addr, timeout time.Duration, ssl, starttls bool, sslconfig *tls.Config) (net.Conn, error) {
 	const network = "tcp"
+	dialer := net.Dialer{Timeout: timeout, LocalAddr: localAddr}
 	if timeout != 0 {
-		if ssl {
-			// unfortunately tls does not provide a DialTimeout
-			// so lets try to replicate the behavior of Dial
-			if nc, err = net.DialTimeout(network, addr, timeout); err != nil {
-				return nil, err
-			}
-			var config *tls.Config
-			if sslconfig != nil {
-				config = sslconfig
-			} else {
-				config = &tls.Config{}
-			}
-			if config.ServerName == "" {
-				idx := strings.LastIndex(addr, ":")
-				if idx == -1 {
-					idx = len(addr)
-				}
-				config.ServerName = addr[:idx]
-			}
-			tc := tls.Client(nc, config)
-			if err = tc.Handshake(); err != nil {
-				nc.Close()
-				return nil, err
-			}
-			nc = tc
-		} else {
-			nc, err = net.DialTimeout(network, addr, timeout)
-		}
+		// the timeout covers the TLS handshake too
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	nc, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if ssl {
+		return tlsHandshake(ctx, nc, addr, sslconfig)
+	} else if starttls {
+		return startTLS(ctx, nc, addr, sslconfig)
+	}
+	return nc, nil
+}
+
+// tlsHandshake wraps nc in a TLS client. On error, nc is closed.
+func tlsHandshake(ctx context.Context, nc net.Conn, addr string, sslconfig *tls.Config) (net.Conn, error) {
+	var config *tls.Config
+	if sslconfig != nil {
+		config = sslconfig.Clone()
 	} else {
-		if ssl {
-			nc, err = tls.Dial(network, addr, sslconfig)
-		} else {
-			nc, err = net.Dial(network, addr)
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		idx := strings.LastIndex(addr, ":")
+		if idx == -1 {
+			idx = len(addr)
 		}
+		config.ServerName = addr[:idx]
+	}
+	tc := tls.Client(nc, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		nc.Close()
+		return nil, err
 	}
-	return nc, err
+	return tc, nil
 }
 
-func connWriter(nc net.Conn, c <-chan string, writeErr chan<- error, allowFlood bool) {
-	// set up the infinite queue
-	queue := make(chan string)
+// startTLS issues a STARTTLS and waits for the server to agree before
+// performing the TLS handshake. On error, nc is closed.
+func startTLS(ctx context.Context, nc net.Conn, addr string, sslconfig *tls.Config) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+		defer nc.SetDeadline(time.Time{})
+	}
+	if _, err := io.WriteString(nc, "STARTTLS\r\n"); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	for {
+		input, err := readLineUnbuffered(nc)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		line := parseLine(input)
+		switch line.Command {
+		case RPL_STARTTLS:
+			return tlsHandshake(ctx, nc, addr, sslconfig)
+		case ERR_STARTTLS, ERR_UNKNOWNCOMMAND, ERR_NOTREGISTERED:
+			nc.Close()
+			return nil, errors.New("STARTTLS failed: " + input)
+		}
+		// anything else, like a server NOTICE, can be ignored
+	}
+}
+
+// readLineUnbuffered reads a single line from r without reading past it, so
+// that r can subsequently be handed to the TLS client.
+func readLineUnbuffered(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+}
+
+func connWriter(nc net.Conn, c <-chan string, writeErr chan<- error, flood FloodProfile, config *Config, queued *queueCount, stats *connStats) {
+	// set up the queue, with a separate lane for priority lines
+	queue, urgent := make(chan string), make(chan string)
 	go func() {
-		var buf []string
-	loop:
-		for {
+		var buf, prio []string
+		for c != nil || len(buf) > 0 || len(prio) > 0 {
+			// a nil channel is never ready, which disables its case
+			var out, urgentOut chan<- string
+			var next, nextUrgent string
 			if len(buf) > 0 {
-				select {
-				case input, ok := <-c:
-					if !ok {
-						break loop
-					}
-					buf = append(buf, input)
-				case queue <- buf[0]:
-					buf = buf[1:]
+				out, next = queue, buf[0]
+			}
+			if len(prio) > 0 {
+				urgentOut, nextUrgent = urgent, prio[0]
+			}
+			select {
+			case line, ok := <-c:
+				// the senders have counted the line, and waited for room
+				// or dropped it according to the QueuePolicy, so lines are
+				// always accepted. Priority lines are never held up.
+				if !ok {
+					c = nil
+					continue
 				}
-			} else {
-				if input, ok := <-c; ok {
-					select {
-					case queue <- input:
-					default:
-						buf = append(buf, input)
+				if config.OutboundFilter != nil {
+					if line = filterUnsafe(config.OutboundFilter(line)); line == "" {
+						queued.remove(1)
+						continue
 					}
-				} else {
-					break loop
 				}
+				if isPriority(line, config.PriorityQuit) {
+					prio = append(prio, line)
+					continue
+				}
+				if config.MaxQueue > 0 && len(buf) >= config.MaxQueue && config.QueuePolicy == QueueDropOldest {
+					buf = buf[1:]
+					queued.remove(1)
+				}
+				buf = append(buf, line)
+			case out <- next:
+				buf = buf[1:]
+			case urgentOut <- nextUrgent:
+				prio = prio[1:]
 			}
 		}
-		for _, elt := range buf {
-			queue <- elt
-		}
 		close(queue)
+		close(urgent)
 	}()
+	var encoder *encoding.Encoder
+	if config.Encoding != nil {
+		encoder = encoding.ReplaceUnsupported(config.Encoding.NewEncoder())
+	}
+	write := func(line string) error {
+		if encoder != nil {
+			if encoded, err := encoder.String(line); err == nil {
+				line = encoded
+			}
+		}
+		if config.WriteTimeout > 0 {
+			nc.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+		}
+		_, err := io.WriteString(nc, line+"\r\n")
+		queued.remove(1)
+		if err == nil {
+			stats.sent(line)
+		}
+		return err
+	}
 	// read from the queue and write to the wire
-	// implement flood protection unless allowFlood is true.
+	// implement flood protection unless the profile is zero.
 	// Use the flood protection algorithm from Hybrid IRCd.
-	// This is the normal 2-second penalty, plus 1/120th of a second per character.
-	const maxTimeDelta = 10 * time.Second
+	// Priority lines are written immediately, even while waiting for the
+	// flood protection, and don't accrue a penalty.
+	allowFlood := flood == FloodProfile{}
 	var floodTime time.Time
-	for line := range queue {
+	var err error
+loop:
+	for queue != nil || urgent != nil {
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-urgent:
+			if !ok {
+				urgent = nil
+				continue
+			}
+			if err = write(line); err != nil {
+				break loop
+			}
+			continue
+		default:
+		}
+		select {
+		case line, ok = <-urgent:
+			if !ok {
+				urgent = nil
+				continue
+			}
+			if err = write(line); err != nil {
+				break loop
+			}
+			continue
+		case line, ok = <-queue:
+			if !ok {
+				queue = nil
+				continue
+			}
+		}
 		if !allowFlood {
 			now := time.Now()
 			if now.After(floodTime) {
 				floodTime = now
 			}
-			penalty := 2*time.Second + (time.Second * time.Duration(len(line)) / 120)
+			penalty := flood.Penalty + flood.PerByte*time.Duration(len(line))
 			floodTime = floodTime.Add(penalty)
 			delta := floodTime.Sub(now)
-			if delta > maxTimeDelta {
+			if delta > flood.Burst {
 				// sleep until we're good again
-				<-time.After(delta - maxTimeDelta)
+				timer := time.NewTimer(delta - flood.Burst)
+			wait:
+				for {
+					select {
+					case <-timer.C:
+						break wait
+					case p, ok := <-urgent:
+						if !ok {
+							urgent = nil
+						} else if err = write(p); err != nil {
+							timer.Stop()
+							break loop
+						}
+					}
+				}
+				stats.delayed(delta - flood.Burst)
 			}
 		}
-		if _, err := io.WriteString(nc, line+"\r\n"); err != nil {
-			writeErr <- err
+		if err = write(line); err != nil {
 			break
 		}
 	}
+	if err != nil {
+		writeErr <- err
+	}
 	close(writeErr)
-	// exhaust the queue so we don't leak the goroutine
-	for _ = range queue {
+	// exhaust the queues so we don't leak the goroutine. The lines are
+	// discarded, so they're no longer queued.
+	for queue != nil || urgent != nil {
+		select {
+		case _, ok := <-queue:
+			if !ok {
+				queue = nil
+			} else {
+				queued.remove(1)
+			}
+		case _, ok := <-urgent:
+			if !ok {
+				urgent = nil
+			} else {
+				queued.remove(1)
+			}
+		}
 	}
 }
 
-func connReader(nc net.Conn, c chan<- string, readErr chan<- error) {
+// maxLineLen is the longest line connReader accepts, not counting the CRLF:
+// 8191 bytes of tags, plus the 512 bytes of the rest of the line.
+const maxLineLen = 8191 + 512
+
+// newLineScanner returns a scanner for the lines read from r, which skips
+// lines longer than maxLineLen.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxLineLen+2)
+	scanner.Split(scanLines())
+	return scanner
+}
+
+// scanLines returns a split function like scanCRLF, except that a line longer
+// than maxLineLen is skipped, rather than failing with ErrTooLong.
+func scanLines() bufio.SplitFunc {
+	skipping := false
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = scanCRLF(data, atEOF)
+		if advance == 0 && len(data) >= maxLineLen+2 {
+			// too long. Discard what we have, and the rest of the line. A
+			// final CR is kept, as it may be the start of the CRLF.
+			skipping = true
+			if data[len(data)-1] == '\r' {
+				return len(data) - 1, nil, nil
+			}
+			return len(data), nil, nil
+		}
+		if skipping && advance > 0 {
+			// the end of the skipped line
+			skipping = false
+			return advance, nil, nil
+		}
+		return
+	}
+}
+
+// scanCRLF splits lines strictly on CRLF, as IRC requires. Unlike
+// bufio.ScanLines, a lone CR or LF doesn't end the line.
+func scanCRLF(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.Index(data, []byte("\r\n")); i != -1 {
+		return i + 2, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		// the final, unterminated line
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// isPriority returns whether the line should skip ahead of the queued lines
+// and the flood protection. PING and PONG are always sent ahead, so a backlog
+// can't cause a ping timeout on either side.
+func isPriority(line string, priorityQuit bool) bool {
+	if strings.HasPrefix(line, "@") {
+		// skip the tags
+		if idx := strings.IndexByte(line, ' '); idx != -1 {
+			line = line[idx+1:]
+		}
+	}
+	command := line
+	if idx := strings.IndexByte(line, ' '); idx != -1 {
+		command = line[:idx]
+	}
+	return command == "PING" || command == "PONG" || (priorityQuit && command == "QUIT")
+}
+
+func connReader(nc net.Conn, c chan<- string, readErr chan<- error, timeout time.Duration, stats *connStats, enc encoding.Encoding) {
 	// set up the infinite queue
 	queue := make(chan string)
 	go func() {
@@ -262,9 +706,26 @@ func connReader(nc net.Conn, c chan<- string, readErr chan<- error) {
 		close(c)
 	}()
 	// read from the wire and write to the queue
-	scanner := bufio.NewScanner(nc) // defaults to SplitLines
-	for scanner.Scan() {
-		queue <- scanner.Text()
+	scanner := newLineScanner(nc)
+	var decoder *encoding.Decoder
+	if enc != nil {
+		decoder = enc.NewDecoder()
+	}
+	for {
+		if timeout > 0 {
+			nc.SetReadDeadline(time.Now().Add(timeout))
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Text()
+		stats.received(line)
+		if decoder != nil {
+			if decoded, err := decoder.String(line); err == nil {
+				line = decoded
+			}
+		}
+		queue <- line
 	}
 	if scanner.Err() != nil {
 		readErr <- scanner.Err()
@@ -304,14 +765,40 @@ loop:
 	close(output)
 }
 
-func pinger(conn SafeConn, delta time.Duration) {
+// ErrPingTimeout is the reason the connection was shut down if the server
+// didn't answer a PING before the next one was due.
+var ErrPingTimeout = errors.New("irc: ping timeout")
+
+func pinger(state *safeConnState, conn SafeConn, delta time.Duration, closed <-chan struct{}) {
 	ticker := time.NewTicker(delta)
+	defer ticker.Stop()
 	for {
-		t := <-ticker.C
-		if !conn.Raw("PING " + strconv.FormatInt(t.Unix(), 10)) {
-			// connection was shut down
-			ticker.Stop()
-			break
+		select {
+		case t := <-ticker.C:
+			// the token only needs to be unique to this connection
+			token := strconv.FormatInt(t.UnixNano(), 10)
+			if !state.startPing(token) {
+				// the last PING was never answered, so the link is dead
+				conn.Invoke(func(c *Conn) { c.shutdown(ErrPingTimeout) })
+				return
+			}
+			// Conn.Raw isn't subject to QueueDropNewest, unlike SafeConn.Raw
+			if !conn.Invoke(func(c *Conn) { c.Raw("PING " + token) }) {
+				// not sent, so don't wait for the reply
+				state.pong(token)
+			}
+		case <-closed:
+			// connection was shut down. Checking this rather than the
+			// result of Raw means we stop even if it's reconnected.
+			return
 		}
 	}
 }
+
+func watchContext(ctx context.Context, conn SafeConn, closed <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		conn.Invoke(func(c *Conn) { c.Shutdown() })
+	case <-closed:
+	}
+}
@@ -0,0 +1,305 @@
+package irc
+
+import (
+	"golang.org/x/text/encoding/charmap"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestPingWithBacklog(t *testing.T) {
+	// the flood protection keeps the queue full, so SafeConn sends fail or
+	// wait, depending on the policy
+	for _, policy := range []QueuePolicy{QueueDropNewest, QueueBlock} {
+		s := newTestServer(t, Config{
+			PingInterval: 20 * time.Millisecond,
+			MaxQueue:     5,
+			QueuePolicy:  policy,
+		})
+		s.register()
+		stop := make(chan bool)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					s.conn.Privmsg("#chan", "backlog")
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+		pings, pongs := 0, 0
+		for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+			line := s.next()
+			if strings.HasPrefix(line, "PING ") {
+				pings++
+				s.send("PONG srv :"+strings.TrimPrefix(line, "PING "), "PING :from server")
+			} else if line == "PONG :from server" {
+				pongs++
+			}
+		}
+		close(stop)
+		if pings < 3 || pongs < 2 {
+			t.Errorf("policy %d: only %d PINGs and %d PONGs were sent", policy, pings, pongs)
+		}
+		if !s.conn.Connected() {
+			t.Errorf("policy %d: disconnected with %v", policy, s.conn.LastError())
+		}
+	}
+}
+
+func TestIsPriority(t *testing.T) {
+	tests := []struct {
+		line         string
+		priorityQuit bool
+		want         bool
+	}{
+		{"PING 12345", false, true},
+		{"PONG :irc.example.net", false, true},
+		{"@label=L1 PONG :x", false, true},
+		{"QUIT :bye", false, false},
+		{"QUIT :bye", true, true},
+		{"PRIVMSG #chan :PING", false, false},
+		{"PINGS", false, false},
+	}
+	for _, test := range tests {
+		if got := isPriority(test.line, test.priorityQuit); got != test.want {
+			t.Errorf("isPriority(%q, %v) = %v, want %v", test.line, test.priorityQuit, got, test.want)
+		}
+	}
+}
+
+func TestOutboundFilter(t *testing.T) {
+	s := newTestServer(t, Config{
+		AllowFlood: true,
+		OutboundFilter: func(line string) string {
+			switch {
+			case strings.HasPrefix(line, "PRIVMSG #drop "):
+				return ""
+			case strings.HasPrefix(line, "PRIVMSG "):
+				// the filter may produce bytes that aren't UTF-8
+				return strings.Replace(line, "é", "\xe9", -1) + "\r\nQUIT"
+			}
+			return line
+		},
+	})
+	s.register()
+	s.conn.Privmsg("#drop", "dropped")
+	s.conn.Privmsg("#chan", "café")
+	s.expect("PRIVMSG #chan :caf\xe9QUIT")
+}
+
+func TestInboundFilter(t *testing.T) {
+	var seen []string
+	s := newTestServer(t, Config{
+		AllowFlood: true,
+		Encoding:   charmap.Windows1252,
+		InboundFilter: func(raw string) (string, bool) {
+			seen = append(seen, raw)
+			switch {
+			case strings.Contains(raw, "spam"):
+				return raw, false
+			case strings.HasPrefix(raw, "PING :old"):
+				return "PING :new", true
+			case strings.HasPrefix(raw, ":bob!b@h PRIVMSG me :"):
+				return strings.Replace(raw, "bob", "carol", 1), true
+			}
+			return raw, true
+		},
+	})
+	raws := make(chan string, 5)
+	s.conn.AddHandler(RAW, func(_ *Conn, line Line) { raws <- line.Raw })
+	privmsgs := make(chan Line, 5)
+	s.conn.AddHandler("PRIVMSG", func(_ *Conn, line Line) { privmsgs <- line })
+	s.register()
+	<-raws // RPL_WELCOME
+
+	// dropped lines aren't handled at all, even internally
+	s.send("PING :spam", ":bob!b@h PRIVMSG me :spam", "PING :old", ":bob!b@h PRIVMSG me :caf\xe9")
+	s.expect("PONG :new")
+	line := <-privmsgs
+	if line.Src.Nick != "carol" || line.Args[1] != "café" {
+		t.Errorf("PRIVMSG from %q: %q", line.Src.Nick, line.Args[1])
+	}
+	if got, want := []string{<-raws, <-raws}, []string{"PING :new", ":carol!b@h PRIVMSG me :café"}; !equalStrings(got, want) {
+		t.Errorf("RAW = %q, want %q", got, want)
+	}
+	if lines := s.sync(); len(lines) != 0 {
+		t.Errorf("unexpected lines %q", lines)
+	}
+	select {
+	case line := <-privmsgs:
+		t.Errorf("unexpected PRIVMSG %q", line.Raw)
+	default:
+	}
+
+	// the filter sees the decoded lines, on the connection's goroutine
+	done := make(chan []string)
+	s.conn.Invoke(func(*Conn) { done <- append([]string(nil), seen...) })
+	if got, want := <-done, []string{
+		":srv 001 me :Welcome",
+		"PING :spam",
+		":bob!b@h PRIVMSG me :spam",
+		"PING :old",
+		":bob!b@h PRIVMSG me :café",
+		"PING :sync",
+	}; !equalStrings(got, want) {
+		t.Errorf("the filter saw %q, want %q", got, want)
+	}
+}
+
+func TestQueueDropNewestAllOrNothing(t *testing.T) {
+	// after the burst, a line is written every second, so the queue fills
+	s := newTestServer(t, Config{
+		MaxQueue:    3,
+		QueuePolicy: QueueDropNewest,
+		Flood:       &FloodProfile{Penalty: time.Second, Burst: 2 * time.Second},
+	})
+	s.expect("NICK :me", "USER guest 8 * :guest")
+
+	if s.conn.PrivmsgSplit("#chan", "1\n2\n3\n4") {
+		t.Error("PrivmsgSplit of more lines than MaxQueue succeeded")
+	}
+	var wg sync.WaitGroup
+	var sent atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.conn.PrivmsgSplit("#chan", "a\nb") {
+				sent.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	// one line may have been written, or be waiting in the writer
+	if n := sent.Load(); n == 0 || 2*n > 4 {
+		t.Fatalf("%d PrivmsgSplits succeeded", n)
+	}
+	if n := s.conn.QueueLen(); n > 3 {
+		t.Errorf("QueueLen() = %d, over MaxQueue", n)
+	}
+	// the lines of a PrivmsgSplit may interleave with another's
+	for i := 0; i < 2*int(sent.Load()); i++ {
+		s.pipe.SetReadDeadline(time.Now().Add(3 * time.Second))
+		line, err := s.rd.ReadString('\n')
+		if err != nil || (line != "PRIVMSG #chan :a\r\n" && line != "PRIVMSG #chan :b\r\n") {
+			t.Fatalf("got %q, %v", line, err)
+		}
+	}
+}
+
+func TestScanLines(t *testing.T) {
+	long := strings.Repeat("x", maxLineLen)
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"lines", "a\r\nb\r\n", []string{"a", "b"}},
+		{"unterminated", "a\r\nb", []string{"a", "b"}},
+		{"exactly maxLineLen", long + "\r\nok\r\n", []string{long, "ok"}},
+		{"too long", long + "yyy\r\nok\r\n", []string{"ok"}},
+		// the buffer fills up with the CR, and the LF comes next
+		{"CRLF split at the limit", long + "y\r\nok\r\n", []string{"ok"}},
+		{"CR at the limit", long + "y\rz\r\nok\r\n", []string{"ok"}},
+		{"much too long", strings.Repeat(long, 3) + "\r\nok\r\n", []string{"ok"}},
+		{"too long between lines", "a\r\n" + long + "yy\r\nb\r\n", []string{"a", "b"}},
+		{"EOF while skipping", "a\r\n" + long + long, []string{"a"}},
+	}
+	readers := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{"full", func(r io.Reader) io.Reader { return r }},
+		{"half", iotest.HalfReader},
+		{"one byte", iotest.OneByteReader},
+	}
+	for _, test := range tests {
+		for _, reader := range readers {
+			scanner := newLineScanner(reader.wrap(strings.NewReader(test.input)))
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Errorf("%s, %s reader: %v", test.name, reader.name, err)
+			}
+			if !equalStrings(got, test.want) {
+				t.Errorf("%s, %s reader: got %.40q, want %.40q", test.name, reader.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestScanCRLF(t *testing.T) {
+	tests := []struct {
+		data    string
+		atEOF   bool
+		advance int
+		token   string
+	}{
+		{"a\r\nb\r\n", false, 3, "a"},
+		{"\r\n", false, 2, ""},
+		{"a\nb\r\n", false, 5, "a\nb"},
+		{"a\rb\r\n", false, 5, "a\rb"},
+		{"a\n\rb\r\n", false, 6, "a\n\rb"},
+		{"a\r", false, 0, ""},
+		{"a\n", false, 0, ""},
+		{"a\r", true, 2, "a\r"},
+		{"a\n", true, 2, "a\n"},
+		{"", true, 0, ""},
+	}
+	for _, test := range tests {
+		advance, token, err := scanCRLF([]byte(test.data), test.atEOF)
+		if advance != test.advance || string(token) != test.token || err != nil {
+			t.Errorf("scanCRLF(%q, %v) = %d, %q, %v, want %d, %q", test.data, test.atEOF, advance, token, err, test.advance, test.token)
+		}
+	}
+}
+
+func TestReadBareCRLF(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	lines := make(chan Line, 2)
+	s.conn.AddHandler("PRIVMSG", func(_ *Conn, line Line) { lines <- line })
+	s.register()
+	s.pipe.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(s.pipe, ":bob!b@h PRIVMSG me :a\nb\r\n:bob!b@h PRIVMSG me :c\rd\r\n")
+	for _, want := range []string{"a\nb", "c\rd"} {
+		select {
+		case line := <-lines:
+			if line.Args[1] != want {
+				t.Errorf("got %q, want %q", line.Args[1], want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true, Encoding: charmap.Windows1252})
+	received := make(chan string, 1)
+	s.conn.AddHandler("PRIVMSG", func(_ *Conn, line Line) { received <- line.Args[1] })
+	s.register()
+
+	// Windows-1252 bytes are decoded to UTF-8
+	s.send(":bob!b@h PRIVMSG me :caf\xe9 \x80")
+	select {
+	case msg := <-received:
+		if msg != "café €" {
+			t.Errorf("received %q, want %q", msg, "café €")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+
+	// and encoded back, with characters it lacks replaced
+	s.conn.Privmsg("bob", "café € ☃")
+	s.expect("PRIVMSG bob :caf\xe9 \x80 \x1a")
+}
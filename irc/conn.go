@@ -2,9 +2,12 @@
 package irc
 
 import (
+	"crypto/tls"
+	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"net"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -16,10 +19,13 @@ const (
 	// Args: (*Conn)
 	INIT = "irc:init"
 	// Invoked when the server login has finished. It is now safe to send
-	// messages to the server.
+	// messages to the server. Conn.Welcome() returns the registration
+	// numerics received so far. By default this is invoked on RPL_MYINFO
+	// (004); see Config.ConnectedAfterMOTD.
 	// Args: (*Conn)
 	CONNECTED = "irc:connected"
 	// Invoked when the connection with the server is terminated.
+	// Conn.LastError() returns the reason, if any.
 	// Args: (*Conn)
 	DISCONNECTED = "irc:disconnected"
 	// Invoked for privmsgs that encode CTCP ACTIONs.
@@ -32,6 +38,7 @@ const (
 	// The Line will have 1 or 2 args, the first is the CTCP command, the
 	// second is the remainder, if any.
 	// Line.Dst will contain the original target of the PRIVMSG.
+	// See also CTCPEvent().
 	CTCP = "irc:ctcp"
 	// Invoked for notices that encode CTCP messages.
 	// Args: (*Conn, Line)
@@ -39,11 +46,150 @@ const (
 	// second is the remainder, if any.
 	// Line.Dst will contain the original target of the NOTICE.
 	CTCPREPLY = "irc:ctcpreply"
+	// Invoked for CTCP DCC SEND and CHAT offers.
+	// Args: (*Conn, Line)
+	// The Line will have 2 args, the DCC type and the remainder.
+	// Line.Dst will contain the original target of the PRIVMSG.
+	// Line.DCC() returns the parsed offer.
+	DCC = "irc:dcc"
+	// Invoked when a user starts or stops typing, as sent with a TAGMSG with
+	// the +typing client tag.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the state: TypingActive,
+	// TypingPaused, or TypingDone.
+	// Line.Dst will contain the original target of the TAGMSG.
+	TYPING = "irc:typing"
+	// Invoked when a user reacts to a message, as sent with a TAGMSG with the
+	// +draft/react and +draft/reply client tags.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the reaction, such as an emoji.
+	// Line.Dst will contain the original target of the TAGMSG.
+	// Line.Reaction() returns the reaction and the msgid of the message.
+	REACTION = "irc:reaction"
+	// Invoked when an IRCv3 batch has finished. The lines in the batch have
+	// already been dispatched to their handlers as normal, with
+	// Line.BatchRef() identifying the batch.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the batch type.
+	// Line.Batch() returns the batch, including all of its lines.
+	BATCH = "irc:batch"
+	// Invoked when the enabled IRCv3 capabilities change, either because the
+	// server acknowledged a request (CAP ACK), or because it removed them
+	// with cap-notify (CAP DEL). Also invoked when the server advertises new
+	// capabilities with cap-notify (CAP NEW); any of those listed in
+	// Config.Capabilities are requested automatically.
+	// Args: (*Conn, Line)
+	// The Line's first arg is the CAP subcommand, ACK, DEL, or NEW, and the
+	// remaining args are the capability names.
+	CAPCHANGE = "irc:capchange"
+	// Invoked for every line received from the server, before the
+	// command-specific handlers. CTCP messages have not yet been decoded.
+	// Args: (*Conn, Line)
+	RAW = "irc:raw"
+	// Invoked for lines that no handler was invoked for, neither one added
+	// with AddHandler nor one the library uses internally. This is useful for
+	// logging unhandled numerics during development.
+	// Args: (*Conn, Line)
+	UNKNOWN = "irc:unknown"
+	// Invoked when a WHOIS reply has finished (RPL_ENDOFWHOIS).
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the nick that was queried.
+	// Line.Whois() returns the aggregated reply.
+	WHOIS = "irc:whois"
+	// Invoked when a WHOWAS reply has finished (RPL_ENDOFWHOWAS).
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the nick that was queried.
+	// Line.Whowas() returns the aggregated reply.
+	WHOWAS = "irc:whowas"
+	// Invoked when a WHO reply has finished (RPL_ENDOFWHO).
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the mask that was queried.
+	// Line.Who() returns the aggregated reply.
+	WHO = "irc:who"
+	// Invoked when a NAMES reply has finished (RPL_ENDOFNAMES). This happens
+	// in response to a NAMES query, and after joining a channel.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the channel.
+	// Line.Names() returns the aggregated reply.
+	NAMES = "irc:names"
+	// Invoked for each channel in a LIST reply (RPL_LIST). Entries are not
+	// buffered, as a LIST can return many thousands of channels.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the channel.
+	// Line.ListEntry() returns the parsed entry.
+	LIST = "irc:list"
+	// Invoked when a LIST reply has finished (RPL_LISTEND).
+	// Args: (*Conn, Line)
+	LISTEND = "irc:listend"
+	// Invoked when the message of the day has finished (RPL_ENDOFMOTD), or
+	// the server has none (ERR_NOMOTD). This happens during login, and in
+	// response to a MOTD command.
+	// Args: (*Conn, Line)
+	// Line.MOTD() returns the text. Conn.MOTD() returns the same text later.
+	MOTD = "irc:motd"
+	// Invoked for an ISON reply (RPL_ISON).
+	// Args: (*Conn, Line)
+	// The Line will have the nicks that are online as its args.
+	// Line.Ison() returns the same nicks.
+	ISON = "irc:ison"
+	// Invoked for a USERHOST reply (RPL_USERHOST).
+	// Args: (*Conn, Line)
+	// The Line will have the nicks in the reply as its args.
+	// Line.Userhost() returns the parsed reply.
+	USERHOST = "irc:userhost"
+	// Invoked when the server confirms our own JOIN, or refuses it with
+	// ERR_CHANNELISFULL (+l), ERR_INVITEONLYCHAN (+i), ERR_BANNEDFROMCHAN (+b),
+	// ERR_BADCHANNELKEY (+k), or ERR_TOOMANYCHANNELS. There is one event per
+	// channel.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the channel.
+	// Line.JoinResult() returns the result.
+	JOINRESULT = "irc:joinresult"
+	// Invoked when the server reports the online status of a nick added with
+	// Monitor(), both initially and when it changes. There is one event per
+	// nick.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the nick.
+	// Line.MonitorStatus() returns the status.
+	MONITOR = "irc:monitor"
+)
+
+// Commands without a special meaning to the library, named for convenience.
+// These can be used as event names for AddHandler.
+const (
+	// Invoked for a WALLOPS broadcast, sent to users with usermode +w.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the message.
+	WALLOPS = "WALLOPS"
+	// Invoked when a user changes their real name, using the setname
+	// capability. This includes our own changes.
+	// Args: (*Conn, Line)
+	// The Line will have 1 arg, which is the new real name.
+	SETNAME = "SETNAME"
+	// Invoked when a message is deleted, using the draft/message-redaction
+	// capability. This includes our own deletions.
+	// Args: (*Conn, Line)
+	// The Line will have 2 or 3 args: the target, the msgid, and the reason.
+	// Line.Redaction() returns the parsed deletion.
+	REDACT = "REDACT"
 )
 
+// CTCPEvent returns the event name for a specific CTCP command, such as
+// "VERSION". Handlers for this event are invoked before any CTCP handlers.
+// The default CTCP behavior is skipped for commands that have a handler for
+// their specific event, or if there are any CTCP handlers at all. This allows
+// overriding e.g. VERSION while keeping the default behavior for PING.
+// The Line is the same as for CTCP.
+func CTCPEvent(command string) string {
+	return CTCP + ":" + strings.ToUpper(command)
+}
+
 type HandlerRegistry interface {
 	AddHandler(name string, f func(*Conn, Line)) callback.CallbackIdentifier
+	AddHandlerPriority(name string, priority int, f func(*Conn, Line)) callback.CallbackIdentifier
+	AddHandlerOnce(name string, f func(*Conn, Line)) callback.CallbackIdentifier
 	RemoveHandler(callback.CallbackIdentifier)
+	RemoveHandlers(name string)
 }
 
 // Conn represents a connection to a single IRC server.  The only way to get
@@ -58,13 +204,60 @@ type Conn struct {
 	safeConnState *safeConnState
 
 	nickInUse func(string, int) string
+	lastNick  string // the last nick tried by badNick
+
+	// IRCv3 capability negotiation
+	wantCaps       []string
+	capAvailable   map[string]string // as advertised by CAP LS
+	capNegotiating bool
+	capPending     int // outstanding CAP REQs
+
+	// SASL authentication, which happens during capability negotiation
+	saslMech     string
+	saslUser     string
+	saslPassword string
+	saslDone     bool // authentication was attempted
+
+	// pending multi-line query replies
+	whois  map[string]*WhoisReply   // keyed by case-folded nick
+	whowas map[string][]WhowasReply // keyed by case-folded nick
+	who    []WhoReply
+	names  map[string][]ChannelMember // keyed by case-folded channel
+
+	motd        []string // the last complete MOTD
+	motdPending []string
+
+	autoAwayAfter time.Duration
+	autoAwayMsg   string
 
-	netconn  net.Conn
-	writer   chan<- string
-	reader   <-chan string
-	writeErr <-chan error
-	readErr  <-chan error
-	invoker  <-chan func(*Conn)
+	inboundFilter func(string) (string, bool)
+
+	welcome   []Line // registration numerics, until the MOTD ends
+	motdDone  bool
+	afterMOTD bool // dispatch CONNECTED at the end of the MOTD
+	connected bool // CONNECTED was dispatched
+
+	ctcpInfo map[string]string // CTCP replies for VERSION, SOURCE, USERINFO
+
+	batches map[string]*Batch // open batches, keyed by ref
+
+	// outstanding RawLabeled calls
+	labels       map[string]chan<- Line
+	labelBatches map[string]labeledBatch // keyed by batch ref
+
+	whoisWaiters map[string][]*whoisWaiter // outstanding WhoisSync calls, keyed by case-folded nick
+
+	trackState bool
+	channels   map[string]*Channel // keyed by case-folded name
+
+	netconn      net.Conn
+	queued       *queueCount // lines waiting in connWriter
+	writer       chan<- string
+	writerClosed bool
+	reader       <-chan string
+	writeErr     <-chan error
+	readErr      <-chan error
+	invoker      <-chan func(*Conn)
 }
 
 // Me returns the User object that represents the client.
@@ -78,6 +271,40 @@ func (c *Conn) Server() string {
 	return c.safeConnState.server
 }
 
+// RemoteAddr returns the address of the server the connection was actually
+// made to, which may differ from Server() after DNS resolution or through a
+// proxy. Returns nil once disconnected.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.netconn == nil {
+		return nil
+	}
+	return c.netconn.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the connection, or nil once
+// disconnected.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.netconn == nil {
+		return nil
+	}
+	return c.netconn.LocalAddr()
+}
+
+// ConnectionState returns the state of the TLS connection, such as the
+// negotiated version and the server's certificate chain. The second return
+// value is false if the connection doesn't use SSL or StartTLS, or is
+// disconnected.
+func (c *Conn) ConnectionState() (tls.ConnectionState, bool) {
+	return tlsState(c.netconn)
+}
+
+func tlsState(nc net.Conn) (tls.ConnectionState, bool) {
+	if tc, ok := nc.(*tls.Conn); ok {
+		return tc.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
 // Connected returns whether the Conn is currently connected.
 // When the Conn disconnects from the server, it still processes any
 // outstanding lines or invokes.
@@ -88,103 +315,415 @@ func (c *Conn) Connected() bool {
 // AddHandler adds a handler for an IRC command.
 // The return value can be passed to RemoveHandler() later.
 func (c *Conn) AddHandler(event string, f func(*Conn, Line)) callback.CallbackIdentifier {
-	return c.safeConnState.registry.AddCallback(event, f)
+	return c.safeConnState.addHandler(event, event, f)
+}
+
+// AddHandlerPriority adds a handler for an IRC command with the given priority.
+// Handlers with a lower priority are invoked first. AddHandler uses priority
+// 0, and handlers with the same priority are invoked in no particular order.
+// The return value can be passed to RemoveHandler() later.
+func (c *Conn) AddHandlerPriority(event string, priority int, f func(*Conn, Line)) callback.CallbackIdentifier {
+	return c.safeConnState.addHandlerPriority(event, priority, f)
+}
+
+// AddHandlerOnce adds a handler that is removed after it's first invoked.
+// This is useful for waiting for the reply to a query. The return value can
+// be passed to RemoveHandler() to remove it before it's invoked.
+func (c *Conn) AddHandlerOnce(event string, f func(*Conn, Line)) callback.CallbackIdentifier {
+	return c.safeConnState.addHandlerOnce(event, f)
 }
 
 // RemoveHandler removes a previously-added handler.
 func (c *Conn) RemoveHandler(ident callback.CallbackIdentifier) {
-	c.safeConnState.registry.RemoveCallback(ident)
+	c.safeConnState.removeHandler(ident)
+}
+
+// RemoveHandlers removes every handler for an IRC command, including those
+// added with AddHandlerPriority and AddHandlerOnce.
+func (c *Conn) RemoveHandlers(event string) {
+	c.safeConnState.removeHandlers(event)
+}
+
+// Handlers returns the number of handlers added for each event, at any
+// priority. The handlers the library uses internally aren't included.
+func (c *Conn) Handlers() map[string]int {
+	return c.safeConnState.handlerCounts()
+}
+
+// ServerError is the message sent by the server in an ERROR command, which
+// precedes the server closing the connection.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return "irc: server error: " + string(e)
+}
+
+// LastError returns the error that terminated the connection.
+// This is a ServerError if the server sent an ERROR, io.EOF if the server
+// otherwise closed the connection, ErrPingTimeout if the server stopped
+// answering PINGs, or nil if the connection is still open or was terminated
+// with Shutdown() or SafeConn.Close().
+func (c *Conn) LastError() error {
+	// we're the only writer, so no lock is needed for reading
+	return c.safeConnState.lastErr
 }
 
 // Forcibly terminates the connection.
+// Any messages that have not yet been written to the server are discarded.
 func (c *Conn) Shutdown() {
+	c.shutdown(nil)
+}
+
+// Drain terminates the connection once all queued messages have been written
+// to the server. No further messages can be sent after calling this.
+// This is useful after Quit() to ensure the QUIT reaches the server.
+func (c *Conn) Drain() {
+	// closing the writer makes connWriter flush its queue and then close
+	// writeErr, at which point runLoop shuts us down.
+	c.closeWriter()
+}
+
+// QueueLen returns the number of messages waiting to be written to the server.
+func (c *Conn) QueueLen() int {
+	return c.queued.len()
+}
+
+// shutdown terminates the connection, recording the given error as the reason.
+func (c *Conn) shutdown(err error) {
 	if c.netconn != nil {
 		c.netconn.Close()
 		c.netconn = nil
 
+		c.closeWriter()
+		c.closeLabels()
 		c.safeConnState.Lock()
-		close(c.writer)
-		c.safeConnState.writer = nil
-		c.safeConnState.invoker = nil
+		if c.safeConnState.closing {
+			// SafeConn.Close, which is reported like Shutdown
+			err = nil
+			c.safeConnState.closing = false
+		}
+		c.safeConnState.lastErr = err
+		c.safeConnState.live = false
+		c.safeConnState.netconn = nil
 		c.safeConnState.Unlock()
 
-		c.safeConnState.registry.Dispatch(DISCONNECTED, c)
+		c.safeConnState.dispatch(DISCONNECTED, c)
+	}
+}
+
+// closeWriter stops accepting messages, both from the Conn and any SafeConns.
+func (c *Conn) closeWriter() {
+	if c.writerClosed {
+		return
+	}
+	c.writerClosed = true
+	c.safeConnState.Lock()
+	close(c.writer)
+	c.safeConnState.writer = nil
+	c.safeConnState.invoker = nil
+	close(c.safeConnState.closed)
+	c.safeConnState.Unlock()
+}
+
+// markActive records outgoing activity for auto-away.
+func (c *Conn) markActive() {
+	if c.safeConnState.markActive() {
+		c.send(composeAway(""))
 	}
 }
 
+// send queues a line to be written to the server.
+// Lines sent after the connection was shut down are discarded.
+// With QueueBlock, this waits while the queue is full; PING, PONG, and
+// priority QUITs never wait.
+func (c *Conn) send(line string) {
+	if c.writerClosed {
+		return
+	}
+	if isPriority(line, c.safeConnState.config.PriorityQuit) {
+		c.queued.add(1)
+	} else if !c.queued.reserve(1, nil) {
+		// dropped by QueueDropNewest
+		return
+	}
+	c.writer <- line
+}
+
 // Send a raw line to the server.
 func (c *Conn) Raw(msg string) {
-	c.writer <- filterMessage(firstLine(msg))
+	c.send(filterMessage(firstLine(msg)))
+}
+
+// Send a raw line to the server verbatim, except that NUL, CR, and LF are
+// removed. Unlike Raw, the line is neither cut off at the first newline nor
+// truncated to the 510 byte limit, so it's the caller's responsibility to
+// ensure it's valid. Servers may reject or truncate overlong lines. This is
+// intended for relaying lines that were already validated, e.g. by a bouncer.
+func (c *Conn) RawUnsafe(line string) {
+	c.send(filterUnsafe(line))
+}
+
+// Send a raw line to the server, formatted with fmt.Sprintf.
+func (c *Conn) Rawf(format string, args ...interface{}) {
+	c.Raw(fmt.Sprintf(format, args...))
 }
 
 // Send a PRIVMSG to the server.
+// The dst is passed through as-is up to the first space, so it may be a
+// comma-separated list of targets if the server allows it.
 func (c *Conn) Privmsg(dst, msg string) {
-	c.writer <- composePrivmsg(dst, msg)
+	c.markActive()
+	c.send(composePrivmsg(dst, msg))
+}
+
+// Reply sends a PRIVMSG in reply to the line, to its ReplyTarget().
+func (c *Conn) Reply(line Line, msg string) {
+	c.Privmsg(line.ReplyTarget(), msg)
+}
+
+// Send a PRIVMSG to several targets at once, as a single line.
+// Servers limit the number of targets; see the TARGMAX ISUPPORT token.
+func (c *Conn) PrivmsgMulti(targets []string, msg string) {
+	if len(targets) > 0 {
+		c.markActive()
+		c.send(composePrivmsgMulti(targets, msg))
+	}
+}
+
+// Send a PRIVMSG to the server, split across as many lines as necessary.
+// The message is split at newlines, and long lines are wrapped rather than
+// truncated.
+func (c *Conn) PrivmsgSplit(dst, msg string) {
+	c.markActive()
+	for _, line := range composePrivmsgSplit(dst, msg, sourceReserve(c.me)) {
+		c.send(line)
+	}
 }
 
 // Send an action to the server.
 func (c *Conn) Action(dst, msg string) {
-	c.writer <- composeCTCP(dst, "ACTION", msg, false)
+	c.markActive()
+	c.send(composeCTCP(dst, "ACTION", msg, false))
 }
 
 // Send a NOTICE to the server.
 func (c *Conn) Notice(dst, msg string) {
-	c.writer <- composeNotice(dst, msg)
+	c.send(composeNotice(dst, msg))
+}
+
+// Send a NOTICE to the server, split across as many lines as necessary.
+// The message is split at newlines, and long lines are wrapped rather than
+// truncated.
+func (c *Conn) NoticeSplit(dst, msg string) {
+	for _, line := range composeNoticeSplit(dst, msg, sourceReserve(c.me)) {
+		c.send(line)
+	}
 }
 
 // Send a CTCP message to the server.
 func (c *Conn) CTCP(dst, command, args string) {
-	c.writer <- composeCTCP(dst, command, args, false)
+	c.send(composeCTCP(dst, command, args, false))
 }
 
 // Send a CTCP reply to the server.
 func (c *Conn) CTCPReply(dst, command, args string) {
-	c.writer <- composeCTCP(dst, command, args, true)
+	c.send(composeCTCP(dst, command, args, true))
+}
+
+// Send a DCC offer to the server. The caller is responsible for listening on
+// offer.Addr, which must be reachable by the recipient.
+// The offer is ignored if offer.Addr is nil.
+func (c *Conn) SendDCC(dst string, offer DCCOffer) {
+	if offer.Addr != nil {
+		c.send(composeDCC(dst, offer))
+	}
 }
 
 // Send a JOIN to the server.
+// keys[i] is the key for channels[i], and may be empty if that channel has no
+// key. keys may be shorter than channels, or nil.
 func (c *Conn) Join(channels, keys []string) {
 	if len(channels) > 0 {
-		c.writer <- composeJoin(channels, keys)
+		c.send(composeJoin(channels, keys))
+	}
+}
+
+// Send a JOIN to the server for every channel in the map, which maps each
+// channel to its key, or to "" if it has no key.
+func (c *Conn) JoinKeys(channels map[string]string) {
+	if len(channels) > 0 {
+		c.send(composeJoinKeys(channels))
 	}
 }
 
 // send a PART to the server.
 func (c *Conn) Part(channels []string, msg string) {
 	if len(channels) > 0 {
-		c.writer <- composePart(channels, msg)
+		c.send(composePart(channels, msg))
 	}
 }
 
+// send a PART for a single channel to the server. The reason may be empty.
+func (c *Conn) PartChannel(channel, reason string) {
+	c.send(composePart([]string{channel}, reason))
+}
+
 // Send a QUIT to the server.
 func (c *Conn) Quit(msg string) {
-	c.writer <- composeQuit(msg)
+	c.send(composeQuit(msg))
 }
 
 // Send a NICK to the server.
+// The nick is truncated to the server's NICKLEN, if known.
 func (c *Conn) Nick(newnick string) {
-	c.writer <- composeNick(newnick)
+	c.send(composeNick(newnick, c.isupportInt("NICKLEN")))
+}
+
+// Send a SETNAME to the server, changing our real name. This requires the
+// setname capability.
+func (c *Conn) SetName(realname string) {
+	c.send(composeSetName(realname))
+}
+
+// Send a TOPIC to the server, setting the channel topic.
+// An empty topic clears it.
+func (c *Conn) Topic(channel, topic string) {
+	c.send(composeTopic(channel, topic))
+}
+
+// Send a KICK to the server. The reason may be empty.
+func (c *Conn) Kick(channel, nick, reason string) {
+	c.send(composeKick(channel, nick, reason))
+}
+
+// Send a MODE to the server.
+// The modes are the mode string followed by any mode arguments, e.g.
+// Mode("#channel", "+o", "nick") or Mode(conn.Me().Nick, "+i").
+func (c *Conn) Mode(target string, modes ...string) {
+	c.send(composeMode(target, modes))
+}
+
+// KickBan bans the mask from the channel and then kicks the nick, so they
+// can't rejoin in between. If banmask is empty, it's *!*@host using the host
+// known to the state tracker, or nick!*@* if the host isn't known.
+func (c *Conn) KickBan(channel, nick, banmask, reason string) {
+	if banmask == "" {
+		banmask = c.banMask(nick)
+	}
+	c.Mode(channel, "+b", banmask)
+	c.Kick(channel, nick, reason)
+}
+
+// Send a WHOIS to the server.
+// The aggregated reply is delivered to WHOIS handlers.
+func (c *Conn) Whois(nick string) {
+	c.send(composeWhois(nick))
+}
+
+// Send a WHOWAS to the server, asking for at most count entries. If count is
+// 0 or less, the server's default is used.
+// The aggregated reply is delivered to WHOWAS handlers.
+func (c *Conn) Whowas(nick string, count int) {
+	c.send(composeWhowas(nick, count))
+}
+
+// Send a WHO to the server.
+// The aggregated reply is delivered to WHO handlers.
+func (c *Conn) Who(mask string) {
+	c.send(composeWho(mask))
+}
+
+// Send a NAMES to the server.
+// If channel is empty, names for all visible channels are requested.
+// The aggregated reply for each channel is delivered to NAMES handlers.
+func (c *Conn) Names(channel string) {
+	c.send(composeNames(channel))
+}
+
+// Send a LIST to the server.
+// The params are passed through, e.g. a comma-separated list of channels.
+// Each entry in the reply is delivered to LIST handlers, followed by LISTEND.
+func (c *Conn) List(params ...string) {
+	c.send(composeList(params))
+}
+
+// Send an ISON to the server, to check which of the nicks are online.
+// The reply is delivered to ISON handlers.
+func (c *Conn) Ison(nicks ...string) {
+	if len(nicks) > 0 {
+		c.send(composeIson(nicks))
+	}
+}
+
+// Send a USERHOST to the server. Servers accept at most 5 nicks.
+// The reply is delivered to USERHOST handlers.
+func (c *Conn) Userhost(nicks ...string) {
+	if len(nicks) > 0 {
+		c.send(composeUserhost(nicks))
+	}
+}
+
+// Send an INVITE to the server.
+func (c *Conn) Invite(nick, channel string) {
+	c.send(composeInvite(nick, channel))
+}
+
+// Send an OPER to the server.
+// The password is sent as the trailing parameter, so it may contain spaces.
+func (c *Conn) Oper(name, password string) {
+	c.send(composeOper(name, password))
+}
+
+// Send a WALLOPS to the server. This requires operator privileges.
+func (c *Conn) Wallops(msg string) {
+	c.send(composeWallops(msg))
+}
+
+// Send an AWAY to the server, marking the client as away.
+// If msg is empty, this is the same as Back().
+func (c *Conn) Away(msg string) {
+	c.send(composeAway(msg))
+}
+
+// Send an AWAY to the server, marking the client as no longer away.
+func (c *Conn) Back() {
+	c.send(composeAway(""))
+}
+
+// IsAway returns whether the server considers the client to be away.
+// This is updated when the server acknowledges an AWAY command.
+func (c *Conn) IsAway() bool {
+	// we're the only writer, so no lock is needed for reading
+	return c.safeConnState.away
+}
+
+// UserModes returns our own user modes, such as "iw", in sorted order.
+// This is updated from RPL_UMODEIS and from MODE lines that target us.
+func (c *Conn) UserModes() string {
+	// we're the only writer, so no lock is needed for reading
+	return c.safeConnState.umodes
 }
 
 // DefaultCTCPHandler processes an incoming CTCP message with some default
-// behavior.  For example, it will respond to PING, TIME, and VERSION requests.
-// This function is called by default if no handler is registered for CTCP. If
-// one is registered for CTCP, you may call this function yourself in order to
-// invoke default behavior.
+// behavior.  For example, it will respond to PING, TIME, VERSION, and
+// CLIENTINFO requests.
+// This function is called by default if no handler is registered for CTCP or
+// for the specific CTCPEvent(). If one is registered, you may call this
+// function yourself in order to invoke default behavior.
 func (c *Conn) DefaultCTCPHandler(line Line) {
 	defaultCTCPHandler(c, line)
 }
 
-var lastNick string
-
 func (c *Conn) badNick(oldnick string, errCode int) string {
 	if oldnick == "" {
 		// where's our nick?
 		c.Shutdown()
 		return ""
 	}
-	if oldnick != lastNick && strings.HasPrefix(lastNick, oldnick) {
-		// must have been too long
+	nicklen := c.isupportInt("NICKLEN")
+	oldnick = truncateNick(oldnick, nicklen)
+	if (c.fold(oldnick) != c.fold(c.lastNick) && strings.HasPrefix(c.fold(c.lastNick), c.fold(oldnick))) || (nicklen > 0 && len(oldnick) >= nicklen) {
+		// must have been too long, or appending would make it so
 		idx := strings.LastIndexFunc(oldnick, func(r rune) bool { return r != '_' })
 		if idx == -1 {
 			// our entire nick is _'s?
@@ -196,38 +735,51 @@ func (c *Conn) badNick(oldnick string, errCode int) string {
 	} else {
 		oldnick += "_"
 	}
-	lastNick = oldnick
+	c.lastNick = oldnick
 	return oldnick
 }
 
-func (c *Conn) logIn(realName string, password string) {
+// logIn sends the registration lines: PASS, then CAP LS, which holds
+// registration open for SASL, then NICK and USER.
+func (c *Conn) logIn(realName string, password string, mode uint) {
 	if password != "" {
 		c.Raw("PASS :" + password)
 	}
+	c.capStart()
 	c.Nick(c.me.Nick)
 	user := firstWord(c.me.User)
 	if user == "" {
 		user = "guest"
 	}
+	// for sourceReserve, until the server tells us our real user
+	c.me.User = user
 	if realName == "" {
 		realName = "guest"
 	}
-	c.Raw("USER " + user + " 8 * :" + realName) // 8 is +i
+	c.me.RealName = realName
+	c.send(composeUser(user, mode, realName))
 }
 
 func (c *Conn) runLoop() {
+	// the idle timer for auto-away. A nil channel never fires.
+	var idle <-chan time.Time
+	if delay := c.checkIdle(); delay > 0 {
+		idle = time.After(delay)
+	}
 	for {
 		select {
+		case <-idle:
+			idle = time.After(c.checkIdle())
 		case line, ok := <-c.reader:
 			if !ok {
 				// read end closed
-				c.Shutdown()
+				c.shutdown(<-c.readErr)
 				return
 			}
 			c.processLine(line)
-		case _ = <-c.writeErr:
+		case err := <-c.writeErr:
 			// write end closed
-			c.Shutdown()
+			c.shutdown(err)
 			return
 		case f := <-c.invoker:
 			f(c)
@@ -236,12 +788,53 @@ func (c *Conn) runLoop() {
 }
 
 func (c *Conn) processLine(input string) {
+	if c.inboundFilter != nil {
+		var keep bool
+		if input, keep = c.inboundFilter(input); !keep {
+			return
+		}
+	}
 	line := parseLine(input)
 	if line.Command == "" {
 		// must be a malformed line. Ignore it
 		return
 	}
 	line.me = c.me
+	line.chantypes = c.chanTypes()
+	line.casemap = c.caseMapping()
+	c.safeConnState.dispatch(RAW, c, line)
+
+	// fill in the account from commands that carry it
+	switch line.Command {
+	case "JOIN":
+		// extended-join: JOIN <channel> <account> :<real name>
+		if len(line.Args) > 2 && c.HasCapability("extended-join") {
+			if line.Args[1] != "*" {
+				line.Src.Account = line.Args[1]
+			}
+			line.Src.RealName = line.Args[2]
+		}
+	case "ACCOUNT":
+		// account-notify: ACCOUNT <account>, or * when logging out
+		if len(line.Args) > 0 {
+			if line.Args[0] == "*" {
+				line.Src.Account = ""
+			} else {
+				line.Src.Account = line.Args[0]
+			}
+		}
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		line.Echo = line.SrcIsMe() && c.HasCapability("echo-message")
+	case "REDACT":
+		if redaction, ok := parseRedaction(line.Args); ok {
+			line.data = redaction
+		}
+	case "MODE":
+		// MODE <channel> <modes> *<params>
+		if len(line.Args) > 1 && c.isChannel(line.Args[0]) {
+			line.data = c.parseModeChanges(line.Args[1:])
+		}
+	}
 
 	// detect CTCP and modify the line accordingly
 	if line.Command == "PRIVMSG" || line.Command == "NOTICE" {
@@ -262,6 +855,14 @@ func (c *Conn) processLine(input string) {
 					} else {
 						line.Args = []string{""}
 					}
+				} else if line.Args[0] == "DCC" && len(line.Args) > 1 {
+					if offer, err := parseDCC(line.Args[1]); err == nil {
+						line.Command = DCC
+						line.Args = strings.SplitN(line.Args[1], " ", 2)
+						line.data = offer
+					} else {
+						line.Command = CTCP
+					}
 				} else {
 					line.Command = CTCP
 				}
@@ -271,9 +872,20 @@ func (c *Conn) processLine(input string) {
 		}
 	}
 
-	// CTCP gets some special handling
-	c.stateRegistry.Dispatch(line.Command, c, line)
-	if !c.safeConnState.registry.Dispatch(line.Command, c, line) && line.Command == CTCP {
-		c.DefaultCTCPHandler(line)
+	c.addToBatch(line)
+	c.routeLabeled(line)
+	c.routeWhois(line)
+
+	handled := c.stateRegistry.Dispatch(line.Command, c, line)
+	if line.Command == CTCP {
+		// CTCP gets some special handling. It's never unknown, as the default
+		// handler covers it.
+		specific := c.safeConnState.dispatch(CTCPEvent(line.Args[0]), c, line)
+		if !c.safeConnState.dispatch(line.Command, c, line) && !specific && !line.Echo {
+			// never reply to our own echoed requests
+			c.DefaultCTCPHandler(line)
+		}
+	} else if !c.safeConnState.dispatch(line.Command, c, line) && !handled {
+		c.safeConnState.dispatch(UNKNOWN, c, line)
 	}
 }
@@ -2,6 +2,7 @@ package irc
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"unicode/utf8"
 )
@@ -12,25 +13,49 @@ import (
 // Note: this function assumes utf8 text, and will trim to lower than 510 if it
 // thinks it broke a utf8 rune in half.
 func filterMessage(text string) string {
-	// byte-wise iteration
-	var bytes []byte
-	var i, j int
-	for i, j = 0, 0; i < len(text); i++ {
-		c := text[i]
-		if c == 0 || c == '\r' || c == '\n' {
-			if bytes == nil {
-				bytes = make([]byte, 0, len(text))
-			}
-			n := copy(bytes[len(bytes):cap(bytes)], text[j:i])
-			bytes = bytes[:len(bytes)+n]
-			j = i + 1
+	i := indexControl(text)
+	if i == -1 || i >= 510 {
+		// the common case, which doesn't allocate
+		return truncateMessage(text)
+	}
+	// copy the runs between the control chars, stopping once there's enough
+	// to be truncated
+	size := len(text)
+	if size > 510+utf8.UTFMax {
+		size = 510 + utf8.UTFMax
+	}
+	var b strings.Builder
+	b.Grow(size)
+	for b.Len() < size {
+		run := text
+		if i != -1 {
+			run = text[:i]
+		}
+		if rest := size - b.Len(); len(run) > rest {
+			run = run[:rest]
+		}
+		b.WriteString(run)
+		if i == -1 {
+			break
 		}
+		text = text[i+1:]
+		i = indexControl(text)
 	}
-	if bytes != nil {
-		n := copy(bytes[len(bytes):cap(bytes)], text[j:])
-		bytes = bytes[:len(bytes)+n]
-		text = string(bytes)
+	return truncateMessage(b.String())
+}
+
+// indexControl returns the index of the first NUL, CR, or LF in text, or -1.
+func indexControl(text string) int {
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c == 0 || c == '\r' || c == '\n' {
+			return i
+		}
 	}
+	return -1
+}
+
+// truncateMessage truncates text to 510 bytes, without breaking a rune.
+func truncateMessage(text string) string {
 	if len(text) > 510 {
 		text = text[:510]
 		if r, _ := utf8.DecodeLastRuneInString(text); r == utf8.RuneError {
@@ -71,6 +96,14 @@ func composePrivmsg(dst, msg string) string {
 	return filterMessage(fmt.Sprintf("PRIVMSG %s :%s", firstWord(dst), firstLine(msg)))
 }
 
+func composePrivmsgMulti(targets []string, msg string) string {
+	newtarget := make([]string, len(targets))
+	for i, t := range targets {
+		newtarget[i] = strings.SplitN(firstWord(t), ",", 2)[0]
+	}
+	return composePrivmsg(strings.Join(newtarget, ","), msg)
+}
+
 func composeNotice(dst, msg string) string {
 	return filterMessage(fmt.Sprintf("NOTICE %s :%s", firstWord(dst), firstLine(msg)))
 }
@@ -95,25 +128,65 @@ func composeQuit(msg string) string {
 	}
 }
 
-func composeNick(nick string) string {
-	return filterMessage("NICK :" + firstLine(nick))
+// composeNick truncates the nick to nicklen bytes. A nicklen of 0 means no
+// limit.
+func composeNick(nick string, nicklen int) string {
+	return filterMessage("NICK :" + truncateNick(firstLine(nick), nicklen))
 }
 
+// truncateNick shortens the nick to at most max bytes, without splitting a
+// UTF-8 sequence. A max of 0 means no limit.
+func truncateNick(nick string, max int) string {
+	if max <= 0 || len(nick) <= max {
+		return nick
+	}
+	for max > 0 && !utf8.RuneStart(nick[max]) {
+		max--
+	}
+	return nick[:max]
+}
+
+// composeJoin pairs keys[i] with channels[i]. JOIN matches keys to channels
+// positionally, so channels with a key are sent first, followed by the
+// channels without one. Keys beyond the last channel are ignored.
 func composeJoin(channels, keys []string) string {
-	newchan, newkey := make([]string, len(channels)), make([]string, len(keys))
+	var keyed, unkeyed, newkey []string
 	for i, c := range channels {
-		newchan[i] = strings.SplitN(firstWord(c), ",", 2)[0]
-	}
-	for i, k := range keys {
-		newkey[i] = strings.SplitN(firstWord(k), ",", 2)[0]
+		c = strings.SplitN(firstWord(c), ",", 2)[0]
+		var k string
+		if i < len(keys) {
+			k = strings.SplitN(firstWord(keys[i]), ",", 2)[0]
+		}
+		if k != "" {
+			keyed = append(keyed, c)
+			newkey = append(newkey, k)
+		} else {
+			unkeyed = append(unkeyed, c)
+		}
 	}
+	newchan := strings.Join(append(keyed, unkeyed...), ",")
 	if len(newkey) > 0 {
-		return filterMessage(fmt.Sprintf("JOIN %s %s", strings.Join(newchan, ","), strings.Join(newkey, ",")))
+		return filterMessage(fmt.Sprintf("JOIN %s %s", newchan, strings.Join(newkey, ",")))
 	} else {
-		return filterMessage(fmt.Sprintf("JOIN %s", strings.Join(newchan, ",")))
+		return filterMessage(fmt.Sprintf("JOIN %s", newchan))
 	}
 }
 
+// composeJoinKeys sorts the channels, so the line is predictable, and lets
+// composeJoin move the keyed channels first.
+func composeJoinKeys(channels map[string]string) string {
+	names := make([]string, 0, len(channels))
+	for c := range channels {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	keys := make([]string, len(names))
+	for i, c := range names {
+		keys[i] = channels[c]
+	}
+	return composeJoin(names, keys)
+}
+
 func composePart(channels []string, msg string) string {
 	newchan := make([]string, len(channels))
 	for i, c := range channels {
@@ -125,3 +198,158 @@ func composePart(channels []string, msg string) string {
 		return filterMessage(fmt.Sprintf("PART %s", strings.Join(newchan, ",")))
 	}
 }
+
+func composeMode(target string, modes []string) string {
+	words := []string{"MODE", firstWord(target)}
+	for _, m := range modes {
+		if m = firstWord(m); m != "" {
+			words = append(words, m)
+		}
+	}
+	return filterMessage(strings.Join(words, " "))
+}
+
+func composeWhois(nick string) string {
+	return filterMessage("WHOIS " + firstWord(nick))
+}
+
+func composeWhowas(nick string, count int) string {
+	if count > 0 {
+		return filterMessage(fmt.Sprintf("WHOWAS %s %d", firstWord(nick), count))
+	}
+	return filterMessage("WHOWAS " + firstWord(nick))
+}
+
+func composeWho(mask string) string {
+	return filterMessage("WHO " + firstWord(mask))
+}
+
+func composeNames(channel string) string {
+	if channel = firstWord(channel); channel != "" {
+		return filterMessage("NAMES " + channel)
+	}
+	return "NAMES"
+}
+
+func composeAway(msg string) string {
+	if msg == "" {
+		return "AWAY"
+	}
+	return filterMessage("AWAY :" + firstLine(msg))
+}
+
+func composeInvite(nick, channel string) string {
+	return filterMessage(fmt.Sprintf("INVITE %s %s", firstWord(nick), firstWord(channel)))
+}
+
+func composeList(params []string) string {
+	return composeWords("LIST", params)
+}
+
+func composeIson(nicks []string) string {
+	return composeWords("ISON", nicks)
+}
+
+func composeUserhost(nicks []string) string {
+	return composeWords("USERHOST", nicks)
+}
+
+// composeWords sends the command with each non-empty param as a single word.
+func composeWords(command string, params []string) string {
+	words := []string{command}
+	for _, p := range params {
+		if p = firstWord(p); p != "" {
+			words = append(words, p)
+		}
+	}
+	return filterMessage(strings.Join(words, " "))
+}
+
+// mode is the RFC 2812 bitmask, where 8 is +i and 4 is +w.
+func composeUser(user string, mode uint, realName string) string {
+	return filterMessage(fmt.Sprintf("USER %s %d * :%s", firstWord(user), mode, firstLine(realName)))
+}
+
+// splitMessage splits msg into lines such that each line, prefixed by prefix,
+// fits within the 510-byte limit less reserve bytes. The message is split at
+// any newlines, and then at spaces where possible. Runes are never split.
+func splitMessage(prefix, msg string, reserve int) []string {
+	max := 510 - reserve - len(prefix)
+	if max < utf8.UTFMax {
+		max = utf8.UTFMax
+	}
+	var lines []string
+	for _, text := range strings.FieldsFunc(msg, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		for len(text) > max {
+			// find the last rune boundary that fits
+			idx := max
+			for idx > 0 && !utf8.RuneStart(text[idx]) {
+				idx--
+			}
+			// prefer to break at a space, as long as it's not too far back
+			if sp := strings.LastIndex(text[:idx], " "); sp > max/2 {
+				idx = sp
+			}
+			lines = append(lines, prefix+text[:idx])
+			text = strings.TrimLeft(text[idx:], " ")
+		}
+		if text != "" {
+			lines = append(lines, prefix+text)
+		}
+	}
+	return lines
+}
+
+// sourceReserve returns the number of bytes to reserve for the source prefix
+// the server adds when relaying our messages, i.e. ":nick!user@host ".
+func sourceReserve(me User) int {
+	host := len(me.Host)
+	if host == 0 {
+		host = 63 // the maximum hostname length
+	}
+	return len(":!@ ") + len(me.Nick) + len(me.User) + 1 + host
+}
+
+func composePrivmsgSplit(dst, msg string, reserve int) []string {
+	return splitMessage(fmt.Sprintf("PRIVMSG %s :", firstWord(dst)), filterNUL(msg), reserve)
+}
+
+func composeNoticeSplit(dst, msg string, reserve int) []string {
+	return splitMessage(fmt.Sprintf("NOTICE %s :", firstWord(dst)), filterNUL(msg), reserve)
+}
+
+func filterNUL(text string) string {
+	return strings.Replace(text, "\x00", "", -1)
+}
+
+// filterUnsafe removes NUL, CR, and LF, so the text can't inject extra lines,
+// but unlike filterMessage doesn't truncate it. Other bytes are left alone,
+// even if they aren't valid UTF-8.
+func filterUnsafe(text string) string {
+	return unsafeReplacer.Replace(text)
+}
+
+var unsafeReplacer = strings.NewReplacer("\x00", "", "\r", "", "\n", "")
+
+func composeSetName(realname string) string {
+	return filterMessage("SETNAME :" + firstLine(realname))
+}
+
+func composeTopic(channel, topic string) string {
+	return filterMessage(fmt.Sprintf("TOPIC %s :%s", firstWord(channel), firstLine(topic)))
+}
+
+func composeKick(channel, nick, reason string) string {
+	if reason != "" {
+		return filterMessage(fmt.Sprintf("KICK %s %s :%s", firstWord(channel), firstWord(nick), firstLine(reason)))
+	}
+	return filterMessage(fmt.Sprintf("KICK %s %s", firstWord(channel), firstWord(nick)))
+}
+
+func composeWallops(msg string) string {
+	return filterMessage("WALLOPS :" + firstLine(msg))
+}
+
+func composeOper(name, password string) string {
+	return filterMessage(fmt.Sprintf("OPER %s :%s", firstWord(name), firstLine(password)))
+}
@@ -0,0 +1,131 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterUnsafe(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"PRIVMSG #chan :hi", "PRIVMSG #chan :hi"},
+		{"PRIVMSG #chan :a\r\nQUIT", "PRIVMSG #chan :aQUIT"},
+		{"a\x00b", "ab"},
+		{"PRIVMSG #chan :caf\xe9", "PRIVMSG #chan :caf\xe9"},
+		{"\xff\xfe\r", "\xff\xfe"},
+	}
+	for _, test := range tests {
+		if got := filterUnsafe(test.in); got != test.want {
+			t.Errorf("filterUnsafe(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRawUnsafeLatin1(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	s.register()
+	s.conn.RawUnsafe("PRIVMSG #chan :caf\xe9\r\n")
+	s.expect("PRIVMSG #chan :caf\xe9")
+}
+
+func TestFilterMessage(t *testing.T) {
+	a := func(n int) string { return strings.Repeat("a", n) }
+	tests := []struct{ in, want string }{
+		{"PRIVMSG #chan :hi", "PRIVMSG #chan :hi"},
+		{"PRIVMSG #chan :a\r\nQUIT", "PRIVMSG #chan :aQUIT"},
+		{"\x00a\x00b\x00", "ab"},
+		{a(510), a(510)},
+		{a(511), a(510)},
+		{a(508) + "é", a(508) + "é"},
+		{a(509) + "é", a(509)},
+		{strings.Repeat("€", 170), strings.Repeat("€", 170)},
+		{strings.Repeat("€", 171), strings.Repeat("€", 170)},
+		{a(509) + "€", a(509)},
+		// removing the control chars makes it fit
+		{strings.Repeat("\n", 10) + a(510), a(510)},
+		{a(505) + "\r\n\r\n\r\n" + "bcdef", a(505) + "bcdef"},
+		{a(510) + "\nzzz", a(510)},
+		{a(200) + "\n" + a(400), a(510)},
+		{a(509) + "\n" + "é", a(509)},
+	}
+	for _, test := range tests {
+		if got := filterMessage(test.in); got != test.want {
+			t.Errorf("filterMessage(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func BenchmarkFilterMessage(b *testing.B) {
+	long := strings.Repeat("abcdefghi\n", 51)
+	benchmarks := []struct{ name, text string }{
+		{"Short", "PRIVMSG #chan :hello there"},
+		{"ControlChars", long},
+		{"Multibyte", "PRIVMSG #chan :" + strings.Repeat("日本語€", 50)},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				filterMessage(bm.text)
+			}
+		})
+	}
+}
+
+func TestComposeJoin(t *testing.T) {
+	tests := []struct {
+		channels, keys []string
+		want           string
+	}{
+		{[]string{"#a"}, nil, "JOIN #a"},
+		{[]string{"#a", "#b"}, nil, "JOIN #a,#b"},
+		{[]string{"#a", "#b"}, []string{"", ""}, "JOIN #a,#b"},
+		{[]string{"#k1"}, []string{"k1"}, "JOIN #k1 k1"},
+		{[]string{"#a", "#k1", "#b", "#k2"}, []string{"", "k1", "", "k2"}, "JOIN #k1,#k2,#a,#b k1,k2"},
+		{[]string{"#k1", "#a", "#k2", "#b"}, []string{"k1", "", "k2"}, "JOIN #k1,#k2,#a,#b k1,k2"},
+		{[]string{"#k1", "#a"}, []string{"k1", "", "extra"}, "JOIN #k1,#a k1"},
+		{[]string{"#a,#b", "#c d"}, []string{"k,x", "y z"}, "JOIN #a,#c k,y"},
+	}
+	for _, test := range tests {
+		if got := composeJoin(test.channels, test.keys); got != test.want {
+			t.Errorf("composeJoin(%q, %q) = %q, want %q", test.channels, test.keys, got, test.want)
+		}
+	}
+}
+
+func TestComposeJoinKeys(t *testing.T) {
+	got := composeJoinKeys(map[string]string{"#b": "", "#k2": "k2", "#a": "", "#k1": "k1"})
+	if want := "JOIN #k1,#k2,#a,#b k1,k2"; got != want {
+		t.Errorf("composeJoinKeys = %q, want %q", got, want)
+	}
+}
+
+func TestComposePrivmsg(t *testing.T) {
+	tests := []struct{ dst, msg, want string }{
+		{"#chan", "hi there", "PRIVMSG #chan :hi there"},
+		{"#a,#b", "hi", "PRIVMSG #a,#b :hi"},
+		{"#a,#b extra", "hi", "PRIVMSG #a,#b :hi"},
+		{"nick", "first\nsecond", "PRIVMSG nick :first"},
+	}
+	for _, test := range tests {
+		if got := composePrivmsg(test.dst, test.msg); got != test.want {
+			t.Errorf("composePrivmsg(%q, %q) = %q, want %q", test.dst, test.msg, got, test.want)
+		}
+	}
+}
+
+func TestComposePrivmsgMulti(t *testing.T) {
+	tests := []struct {
+		targets []string
+		msg     string
+		want    string
+	}{
+		{[]string{"#a"}, "hi", "PRIVMSG #a :hi"},
+		{[]string{"#a", "bob", "#b"}, "hi there", "PRIVMSG #a,bob,#b :hi there"},
+		{[]string{"#a,#x", "bob carol"}, "hi", "PRIVMSG #a,bob :hi"},
+	}
+	for _, test := range tests {
+		if got := composePrivmsgMulti(test.targets, test.msg); got != test.want {
+			t.Errorf("composePrivmsgMulti(%q, %q) = %q, want %q", test.targets, test.msg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package irc
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueLenAfterShutdown(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	s.register()
+	// nothing reads the server end now, so the lines back up
+	for i := 0; i < 20; i++ {
+		s.conn.Privmsg("#chan", "backlog")
+	}
+	if n := s.conn.QueueLen(); n == 0 {
+		t.Fatal("QueueLen() is 0 with a backlog")
+	}
+	s.pipe.Close()
+	deadline := time.Now().Add(time.Second)
+	for s.conn.QueueLen() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("QueueLen() is %d after shutting down", s.conn.QueueLen())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s.conn.Connected() {
+		t.Error("Connected() is true after shutting down")
+	}
+}
+
+func TestLogInOrder(t *testing.T) {
+	payload := "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("user\x00user\x00secret"))
+	tests := []struct {
+		name     string
+		password string
+		sasl     bool
+		saslOK   bool
+		want     []string
+	}{
+		{"pass", "pw", false, false, []string{"PASS :pw", "NICK :me", "USER guest 8 * :guest"}},
+		{"sasl", "", true, true, []string{
+			"CAP LS 302", "NICK :me", "USER guest 8 * :guest",
+			"CAP REQ :sasl", "AUTHENTICATE PLAIN", payload, "CAP END",
+		}},
+		{"pass and sasl", "pw", true, true, []string{
+			"PASS :pw", "CAP LS 302", "NICK :me", "USER guest 8 * :guest",
+			"CAP REQ :sasl", "AUTHENTICATE PLAIN", payload, "CAP END",
+		}},
+		// a failed SASL still finishes registration, using the PASS
+		{"pass and failed sasl", "pw", true, false, []string{
+			"PASS :pw", "CAP LS 302", "NICK :me", "USER guest 8 * :guest",
+			"CAP REQ :sasl", "AUTHENTICATE PLAIN", payload, "CAP END",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connected := make(chan bool, 1)
+			config := Config{
+				Password:   test.password,
+				AllowFlood: true,
+				Init: func(hr HandlerRegistry) {
+					hr.AddHandler(CONNECTED, func(*Conn, Line) { connected <- true })
+				},
+			}
+			if test.sasl {
+				config.SASLMechanism = SASLPlain
+				config.SASLUser = "user"
+				config.SASLPassword = "secret"
+			}
+			s := newTestServer(t, config)
+			want := test.want
+			if test.sasl {
+				// the registration lines, up to the CAP REQ
+				n := len(want) - 4
+				s.expect(want[:n]...)
+				want = want[n:]
+				s.send(":srv CAP * LS :sasl=PLAIN,EXTERNAL")
+				s.expect(want[0])
+				s.send(":srv CAP me ACK :sasl")
+				s.expect(want[1])
+				s.send("AUTHENTICATE +")
+				s.expect(want[2])
+				if test.saslOK {
+					s.send(":srv 903 me :SASL authentication successful")
+				} else {
+					s.send(":srv 904 me :SASL authentication failed")
+				}
+				s.expect(want[3])
+			} else {
+				s.expect(want...)
+			}
+			s.send(":srv 001 me :Welcome", ":srv 004 me srv v1 i o")
+			select {
+			case <-connected:
+			case <-time.After(time.Second):
+				t.Fatal("registration didn't complete")
+			}
+		})
+	}
+}
+
+func TestBadNickPerConnection(t *testing.T) {
+	a := newTestServer(t, Config{Nick: "alice", AllowFlood: true})
+	b := newTestServer(t, Config{Nick: "bob", AllowFlood: true})
+	a.expect("NICK :alice", "USER guest 8 * :guest")
+	b.expect("NICK :bob", "USER guest 8 * :guest")
+
+	a.send(":srv 433 * alice :Nickname is already in use")
+	b.send(":srv 433 * bob :Nickname is already in use")
+	a.expect("NICK :alice_")
+	b.expect("NICK :bob_")
+	// the server truncated alice_ to alice, so the nick is too long. This is
+	// only detected if b's retry didn't overwrite a's last attempt.
+	a.send(":srv 433 * alice :Nickname is already in use")
+	b.send(":srv 433 * bob_ :Nickname is already in use")
+	a.expect("NICK :alic_")
+	b.expect("NICK :bob__")
+}
+
+func TestPrivmsgMulti(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	s.register()
+	s.conn.PrivmsgMulti([]string{"#a", "bob"}, "to both")
+	s.conn.PrivmsgMulti(nil, "to nobody")
+	s.conn.Privmsg("#a,bob", "also to both")
+	s.expect("PRIVMSG #a,bob :to both", "PRIVMSG #a,bob :also to both")
+	if lines := s.sync(); len(lines) != 0 {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
+
+func TestPrivmsgSplitAfterNickChange(t *testing.T) {
+	long := strings.Repeat("x", 30)
+	for _, nicklen := range []string{"30", ""} {
+		s := newTestServer(t, Config{AllowFlood: true})
+		s.register()
+		if nicklen != "" {
+			s.send(":srv 005 me NICKLEN=" + nicklen + " :are supported by this server")
+		}
+		s.send(":me!guest@h NICK " + long)
+		s.sync()
+
+		s.conn.PrivmsgSplit("#chan", strings.Repeat("word ", 300))
+		s.conn.NoticeSplit("#chan", strings.Repeat("word ", 300))
+		s.conn.Privmsg("#chan", "end")
+		var lines []string
+		for line := s.next(); line != "PRIVMSG #chan :end"; line = s.next() {
+			lines = append(lines, line)
+		}
+		// the server relays the lines with our source, and the longest host
+		source := ":" + long + "!guest@" + strings.Repeat("h", 63) + " "
+		if len(lines) < 6 {
+			t.Fatalf("NICKLEN %q: only %d lines", nicklen, len(lines))
+		}
+		for _, line := range lines {
+			if n := len(source + line); n > 510 {
+				t.Errorf("NICKLEN %q: relayed line is %d bytes: %q", nicklen, n, line)
+			}
+		}
+	}
+}
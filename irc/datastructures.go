@@ -9,25 +9,46 @@ import (
 
 type User struct {
 	// Nick, User, and Host will only be present if the user is of the form
-	// nick[!user]@host Notably, a server host sender will have all three fields
-	// as the empty string.
+	// nick[!user][@host]. A server sender will have only Host present, set
+	// to the server name.
 	Nick, User, Host string
 	Raw              string
+
+	// IsServer is true if the sender is a server rather than a user.
+	IsServer bool
+
+	// Account is the services account the user is logged into, if known.
+	// This is only filled in with the account-tag, extended-join, or
+	// account-notify capabilities.
+	Account string
+
+	// RealName is the user's real name, if known. This is only filled in
+	// with the extended-join or setname capabilities, and for Conn.Me().
+	RealName string
 }
 
-var userRegex = regexp.MustCompile("^([a-zA-Z[-`{-}][a-zA-Z0-9[-`{-}\\-]+)(?:!([^@]+))@(.+)$")
+var userRegex = regexp.MustCompile("^([a-zA-Z[-`{-}][a-zA-Z0-9[-`{-}\\-]*)(?:!([^@]+))?(?:@(.+))?$")
 
-// should be called with a string like nick!user@host
+// should be called with a string like nick!user@host or a server name
 func parseUser(raw string) User {
 	user := User{Raw: raw}
 	if matches := userRegex.FindStringSubmatch(raw); matches != nil {
 		user.Nick = matches[1]
 		user.User = matches[2]
 		user.Host = matches[3]
+	} else if raw != "" && strings.IndexAny(raw, "!@") == -1 {
+		// must be a server name
+		user.Host = raw
+		user.IsServer = true
 	}
 	return user
 }
 
+// isNumeric returns whether the command is a 3-digit numeric reply.
+func isNumeric(command string) bool {
+	return len(command) == 3 && strings.Trim(command, "0123456789") == ""
+}
+
 // Returns the user's nickname, or the raw string if there is no nickname.
 func (u User) String() string {
 	if u.Nick != "" {
@@ -52,13 +73,27 @@ type Line struct {
 	Command string
 	Args    []string
 	Raw     string
-	Time    time.Time
+	// Time is the server-time tag if present, otherwise the time the line was
+	// received.
+	Time time.Time
+	// Tags contains the IRCv3 message tags, if any, with values unescaped.
+	// Tags without a value map to the empty string.
+	Tags map[string]string
 
-	// Dst is only filled in for the special commands such as ACTION, CTCP, and
-	// CTCPReply. It denotes the target the PRIVMSG/NOTICE was sent to.
+	// Dst is only filled in for the special commands such as ACTION, CTCP,
+	// CTCPReply, TYPING, and REACTION. It denotes the target the PRIVMSG/NOTICE/TAGMSG
+	// was sent to.
 	Dst string
 
-	me User
+	// Echo is true if this is our own PRIVMSG, NOTICE, or TAGMSG sent back to
+	// us by the server, using the echo-message capability. This includes the
+	// ACTION, CTCP, and CTCPREPLY events derived from those commands.
+	Echo bool
+
+	me        User
+	chantypes string      // the CHANTYPES when the line was received
+	casemap   string      // the CASEMAPPING when the line was received
+	data      interface{} // aggregated reply for synthesized events
 }
 
 func parseLine(input string) (line Line) {
@@ -68,32 +103,177 @@ func parseLine(input string) (line Line) {
 	if len(input) == 0 || input[0] == ' ' {
 		return
 	}
-	// split input, first into "prefix :suffix", and then tokenize prefix
-	comps := strings.SplitN(input, " :", 2)
-	input = comps[0]
-	words := strings.FieldsFunc(input, func(r rune) bool { return r == ' ' })
+	if input[0] == '@' {
+		// IRCv3 message tags
+		idx := strings.IndexByte(input, ' ')
+		if idx == -1 {
+			return
+		}
+		line.Tags = parseTags(input[1:idx])
+		input = strings.TrimLeft(input[idx:], " ")
+		if t, ok := line.Tags["time"]; ok {
+			if st, err := time.Parse(time.RFC3339Nano, t); err == nil {
+				line.Time = st
+			}
+		}
+	}
+	// tokenize per RFC 2812: an optional :prefix, the command, and then the
+	// params, the last of which may be a :trailing param containing spaces
+	words := nextWords(input)
 	if len(words) == 0 {
 		// where's my prefix/command?
 		return
 	} else if words[0][0] == ':' {
 		// it has the expected sender prefix
 		line.Src = parseUser(words[0][1:])
+		line.Src.Account = line.Tags["account"]
 		words = words[1:]
 	}
-	if len(words) == 0 {
+	if len(words) == 0 || words[0][0] == ':' {
 		// where's my command?
 		return
 	}
 	line.Command = words[0]
 	words = words[1:]
-	if len(comps) > 1 {
-		words = append(words, comps[1])
+	if isNumeric(line.Command) && line.Src.Nick != "" && line.Src.User == "" && line.Src.Host == "" {
+		// numerics only come from servers, so this is a server name
+		// without a dot, such as "localhost"
+		line.Src = User{Host: line.Src.Raw, Raw: line.Src.Raw, IsServer: true}
+	}
+	if len(words) > 0 {
+		if last := words[len(words)-1]; last[0] == ':' {
+			words[len(words)-1] = last[1:]
+		}
 	}
 	line.Args = words
 	return
 }
 
-// SrcIsMe returns if the Src is the same as Me.
+// nextWords splits the input on spaces. A word after the first that begins
+// with a colon consumes the rest of the input, including any spaces.
+func nextWords(input string) []string {
+	var words []string
+	for {
+		input = strings.TrimLeft(input, " ")
+		if input == "" {
+			return words
+		}
+		if input[0] == ':' && len(words) > 0 {
+			return append(words, input)
+		}
+		idx := strings.IndexByte(input, ' ')
+		if idx == -1 {
+			return append(words, input)
+		}
+		words = append(words, input[:idx])
+		input = input[idx:]
+	}
+}
+
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, val := tag, ""
+		if idx := strings.IndexByte(tag, '='); idx != -1 {
+			key, val = tag[:idx], unescapeTag(tag[idx+1:])
+		}
+		tags[key] = val
+	}
+	return tags
+}
+
+// unescapeTag decodes the escapes used in IRCv3 tag values.
+func unescapeTag(val string) string {
+	if strings.IndexByte(val, '\\') == -1 {
+		return val
+	}
+	buf := make([]byte, 0, len(val))
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		if c == '\\' {
+			i++
+			if i == len(val) {
+				// a trailing lone backslash is dropped
+				break
+			}
+			switch c = val[i]; c {
+			case ':':
+				c = ';'
+			case 's':
+				c = ' '
+			case 'r':
+				c = '\r'
+			case 'n':
+				c = '\n'
+			}
+			// any other escaped char, including \, is itself
+		}
+		buf = append(buf, c)
+	}
+	return string(buf)
+}
+
+// escapeTag encodes a tag value with the IRCv3 escapes. NUL is removed.
+func escapeTag(val string) string {
+	return tagEscaper.Replace(val)
+}
+
+var tagEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+	"\x00", "",
+)
+
+// SrcIsMe returns if the Src is the same as Me, comparing the nicks using
+// the server's CASEMAPPING.
 func (l *Line) SrcIsMe() bool {
-	return l.Src.Nick == l.me.Nick
+	return FoldCase(l.Src.Nick, l.casemap) == FoldCase(l.me.Nick, l.casemap)
+}
+
+// ReplyTarget returns where a reply to a PRIVMSG or NOTICE should be sent:
+// the channel if it was sent to one, otherwise the sender's nick. For echoed
+// messages, it's the original target. It works for the ACTION, CTCP, and
+// CTCPREPLY events too. Channels are recognized using the CHANTYPES
+// ISUPPORT token.
+func (l *Line) ReplyTarget() string {
+	if l.Echo || l.IsChannel() {
+		return l.Target()
+	}
+	return l.Src.Nick
+}
+
+// Target returns the target a PRIVMSG, NOTICE, or TAGMSG was sent to, which
+// is either a channel or our own nick. For the ACTION, CTCP, CTCPREPLY,
+// TYPING, and REACTION events, it's the Dst.
+func (l *Line) Target() string {
+	if l.Dst != "" {
+		return l.Dst
+	}
+	if len(l.Args) > 0 {
+		return l.Args[0]
+	}
+	return ""
+}
+
+// MsgID returns the IRCv3 msgid tag, which identifies the message for
+// replies and reactions, or "" if the server didn't send one.
+func (l *Line) MsgID() string {
+	return l.Tags["msgid"]
+}
+
+// IsChannel returns whether the Target() is a channel, using the CHANTYPES
+// ISUPPORT token, or "#&" if the server didn't send it.
+func (l *Line) IsChannel() bool {
+	chantypes := l.chantypes
+	if chantypes == "" {
+		// not a line from the server
+		chantypes = "#&"
+	}
+	return isChannelName(l.Target(), chantypes)
 }
@@ -0,0 +1,104 @@
+package irc
+
+import "testing"
+
+func TestParseUser(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want User
+	}{
+		{"a!b@c", User{Nick: "a", User: "b", Host: "c"}},
+		{"nick!user@host.example.com", User{Nick: "nick", User: "user", Host: "host.example.com"}},
+		{"nick@host", User{Nick: "nick", Host: "host"}},
+		{"nick!user", User{Nick: "nick", User: "user"}},
+		{"x", User{Nick: "x"}},
+		{"x!y@z", User{Nick: "x", User: "y", Host: "z"}},
+		{"[a]`^{|}-1", User{Nick: "[a]`^{|}-1"}},
+		{"irc.example.net", User{Host: "irc.example.net", IsServer: true}},
+		// without a dot, a server name looks like a nick; parseLine
+		// recognizes it from the numeric instead
+		{"localhost", User{Nick: "localhost"}},
+		{"1nick!u@h", User{}},
+		{"", User{}},
+	}
+	for _, test := range tests {
+		test.want.Raw = test.raw
+		if got := parseUser(test.raw); got != test.want {
+			t.Errorf("parseUser(%q) = %#v, want %#v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestParseLineServerSource(t *testing.T) {
+	for _, raw := range []string{":localhost 001 me :Welcome", ":irc.example.net 001 me :Welcome", ":irc.example.net NOTICE * :hi"} {
+		line := parseLine(raw)
+		if !line.Src.IsServer || line.Src.Host != line.Src.Raw || line.Src.Nick != "" {
+			t.Errorf("parseLine(%q).Src = %#v, want a server", raw, line.Src)
+		}
+	}
+	if line := parseLine(":localhost NOTICE me :hi"); line.Src.IsServer {
+		t.Errorf("a dotless source of a non-numeric is a server: %#v", line.Src)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		raw     string
+		src     string
+		command string
+		args    []string
+		tags    map[string]string
+	}{
+		{"PING LAG123", "", "PING", []string{"LAG123"}, nil},
+		{"PING :LAG123", "", "PING", []string{"LAG123"}, nil},
+		{":nick!u@h PRIVMSG #chan :hello  world ", "nick!u@h", "PRIVMSG", []string{"#chan", "hello  world "}, nil},
+		{":nick!u@h   PRIVMSG   #chan   :hi", "nick!u@h", "PRIVMSG", []string{"#chan", "hi"}, nil},
+		{"MODE #chan +o   nick  ", "", "MODE", []string{"#chan", "+o", "nick"}, nil},
+		{"CMD a :", "", "CMD", []string{"a", ""}, nil},
+		{"CMD :", "", "CMD", []string{""}, nil},
+		{"CMD a ::x", "", "CMD", []string{"a", ":x"}, nil},
+		{"CMD a b:c", "", "CMD", []string{"a", "b:c"}, nil},
+		{"CMD", "", "CMD", nil, nil},
+		{"@a=b;c :nick!u@h CMD x", "nick!u@h", "CMD", []string{"x"}, map[string]string{"a": "b", "c": ""}},
+		{"@a=b   CMD x", "", "CMD", []string{"x"}, map[string]string{"a": "b"}},
+		{"@a=b", "", "", nil, nil},
+		{"@a=b ", "", "", nil, map[string]string{"a": "b"}},
+		{":nick!u@h", "nick!u@h", "", nil, nil},
+		{":nick!u@h ", "nick!u@h", "", nil, nil},
+		{":nick!u@h :CMD", "nick!u@h", "", nil, nil},
+		{" CMD", "", "", nil, nil},
+		{"", "", "", nil, nil},
+	}
+	for _, test := range tests {
+		line := parseLine(test.raw)
+		if line.Raw != test.raw {
+			t.Errorf("parseLine(%q).Raw = %q", test.raw, line.Raw)
+		}
+		if line.Src.Raw != test.src || line.Command != test.command {
+			t.Errorf("parseLine(%q) = src %q command %q, want src %q command %q", test.raw, line.Src.Raw, line.Command, test.src, test.command)
+		}
+		if !equalStrings(line.Args, test.args) {
+			t.Errorf("parseLine(%q).Args = %q, want %q", test.raw, line.Args, test.args)
+		}
+		if len(line.Tags) != len(test.tags) {
+			t.Errorf("parseLine(%q).Tags = %q, want %q", test.raw, line.Tags, test.tags)
+		}
+		for k, v := range test.tags {
+			if got, ok := line.Tags[k]; !ok || got != v {
+				t.Errorf("parseLine(%q).Tags[%q] = %q, want %q", test.raw, k, got, v)
+			}
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package irc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DCCOffer describes a DCC SEND or CHAT offer.
+type DCCOffer struct {
+	// Type is either "SEND" or "CHAT".
+	Type string
+	// Filename is the name of the file being sent. For inbound offers, any
+	// directory components are stripped. Empty for CHAT.
+	Filename string
+	// Addr is the address to connect to.
+	Addr *net.TCPAddr
+	// Size is the size of the file in bytes, or -1 if unknown. Always -1 for
+	// CHAT.
+	Size int64
+}
+
+// DCC returns the parsed offer for a DCC line.
+// The second return value is false if the line isn't a DCC event.
+func (l *Line) DCC() (DCCOffer, bool) {
+	offer, ok := l.data.(DCCOffer)
+	return offer, ok
+}
+
+// Dial opens the TCP connection described by the offer.
+func (o DCCOffer) Dial(ctx context.Context) (net.Conn, error) {
+	if o.Addr == nil {
+		return nil, errors.New("DCC offer has no address")
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", o.Addr.String())
+}
+
+// parseDCC parses the arguments of a CTCP DCC message, e.g.
+// `SEND "file name.txt" 3232235777 5000 1024`.
+func parseDCC(args string) (DCCOffer, error) {
+	words := splitDCCArgs(args)
+	if len(words) < 4 {
+		return DCCOffer{}, errors.New("malformed DCC request")
+	}
+	offer := DCCOffer{Type: strings.ToUpper(words[0]), Size: -1}
+	switch offer.Type {
+	case "SEND":
+		offer.Filename = sanitizeDCCFilename(words[1])
+		if len(words) > 4 {
+			if size, err := strconv.ParseInt(words[4], 10, 64); err == nil && size >= 0 {
+				offer.Size = size
+			}
+		}
+	case "CHAT":
+		// the argument is conventionally "chat" and carries no meaning
+	default:
+		return DCCOffer{}, fmt.Errorf("unsupported DCC type %q", words[0])
+	}
+	ip, err := parseDCCAddr(words[2])
+	if err != nil {
+		return DCCOffer{}, err
+	}
+	port, err := strconv.ParseUint(words[3], 10, 16)
+	if err != nil || port == 0 {
+		// port 0 requests a reverse (passive) DCC, which isn't supported
+		return DCCOffer{}, fmt.Errorf("invalid DCC port %q", words[3])
+	}
+	offer.Addr = &net.TCPAddr{IP: ip, Port: int(port)}
+	return offer, nil
+}
+
+// parseDCCAddr parses a DCC address. IPv4 addresses are traditionally sent
+// as the decimal form of the 32-bit address in network byte order, while IPv6
+// addresses are sent in their textual form.
+func parseDCCAddr(s string) (net.IP, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(n))
+		return ip, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("invalid DCC address %q", s)
+}
+
+// formatDCCAddr is the inverse of parseDCCAddr.
+func formatDCCAddr(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip4)), 10)
+	}
+	return ip.String()
+}
+
+// splitDCCArgs splits on spaces, but keeps double-quoted filenames together.
+func splitDCCArgs(args string) []string {
+	var words []string
+	for args = strings.TrimLeft(args, " "); args != ""; args = strings.TrimLeft(args, " ") {
+		if args[0] == '"' {
+			if idx := strings.IndexByte(args[1:], '"'); idx != -1 {
+				words = append(words, args[1:idx+1])
+				args = args[idx+2:]
+				continue
+			}
+		}
+		idx := strings.IndexByte(args, ' ')
+		if idx == -1 {
+			idx = len(args)
+		}
+		words = append(words, args[:idx])
+		args = args[idx:]
+	}
+	return words
+}
+
+// sanitizeDCCFilename strips any directory components, so an offer can't be
+// used to write outside of the download directory.
+func sanitizeDCCFilename(name string) string {
+	if idx := strings.LastIndexAny(name, `/\`); idx != -1 {
+		name = name[idx+1:]
+	}
+	if name == "." || name == ".." {
+		name = ""
+	}
+	return name
+}
+
+func composeDCC(dst string, offer DCCOffer) string {
+	var args string
+	addr := formatDCCAddr(offer.Addr.IP)
+	if offer.Type == "CHAT" {
+		args = fmt.Sprintf("CHAT chat %s %d", addr, offer.Addr.Port)
+	} else {
+		name := sanitizeDCCFilename(offer.Filename)
+		if strings.Contains(name, " ") {
+			name = `"` + strings.Replace(name, `"`, "", -1) + `"`
+		}
+		args = fmt.Sprintf("SEND %s %s %d", name, addr, offer.Addr.Port)
+		if offer.Size >= 0 {
+			args += " " + strconv.FormatInt(offer.Size, 10)
+		}
+	}
+	return composeCTCP(dst, "DCC", args, false)
+}
@@ -0,0 +1,144 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// mIRC formatting control codes.
+const (
+	FormatBold          = '\x02'
+	FormatColor         = '\x03'
+	FormatHexColor      = '\x04'
+	FormatReset         = '\x0f'
+	FormatMonospace     = '\x11'
+	FormatReverse       = '\x16'
+	FormatItalic        = '\x1d'
+	FormatStrikethrough = '\x1e'
+	FormatUnderline     = '\x1f'
+)
+
+// Format is the formatting in effect for a span of text.
+type Format struct {
+	Bold          bool
+	Italic        bool
+	Underline     bool
+	Strikethrough bool
+	Monospace     bool
+	Reverse       bool
+	// Fg and Bg are mIRC color numbers, usually 0-15 or 0-98, or -1 for
+	// the default color. Hex colors (\x04) are skipped, and leave these
+	// unchanged.
+	Fg, Bg int
+}
+
+// FormatSpan is a run of text with the same formatting.
+type FormatSpan struct {
+	Text string
+	Format
+}
+
+// StripFormatting removes the mIRC bold, color, italic, underline, and other
+// formatting codes from s, leaving the plain text.
+func StripFormatting(s string) string {
+	if strings.IndexFunc(s, isFormatCode) == -1 {
+		return s
+	}
+	var b strings.Builder
+	for _, span := range ParseFormatting(s) {
+		b.WriteString(span.Text)
+	}
+	return b.String()
+}
+
+// ParseFormatting splits s into spans of text with the mIRC formatting in
+// effect for each. Empty spans are omitted.
+func ParseFormatting(s string) []FormatSpan {
+	var spans []FormatSpan
+	format := Format{Fg: -1, Bg: -1}
+	start := 0
+	for i := 0; i < len(s); {
+		code := s[i]
+		if !isFormatCode(rune(code)) {
+			i++
+			continue
+		}
+		if i > start {
+			spans = append(spans, FormatSpan{Text: s[start:i], Format: format})
+		}
+		i++
+		switch code {
+		case FormatBold:
+			format.Bold = !format.Bold
+		case FormatItalic:
+			format.Italic = !format.Italic
+		case FormatUnderline:
+			format.Underline = !format.Underline
+		case FormatStrikethrough:
+			format.Strikethrough = !format.Strikethrough
+		case FormatMonospace:
+			format.Monospace = !format.Monospace
+		case FormatReverse:
+			format.Reverse = !format.Reverse
+		case FormatReset:
+			format = Format{Fg: -1, Bg: -1}
+		case FormatColor:
+			// \x03[fg[,bg]], where each color is 1 or 2 digits. A bare \x03
+			// resets the colors.
+			fg, n := parseColor(s[i:], isDigit, 2)
+			if n == 0 {
+				format.Fg, format.Bg = -1, -1
+				break
+			}
+			i += n
+			format.Fg, _ = strconv.Atoi(fg)
+			if i+1 < len(s) && s[i] == ',' && isDigit(s[i+1]) {
+				bg, n := parseColor(s[i+1:], isDigit, 2)
+				i += 1 + n
+				format.Bg, _ = strconv.Atoi(bg)
+			}
+		case FormatHexColor:
+			// \x04[RRGGBB[,RRGGBB]]
+			if _, n := parseColor(s[i:], isHexDigit, 6); n == 6 {
+				i += n
+				if i+6 < len(s) && s[i] == ',' {
+					if _, n := parseColor(s[i+1:], isHexDigit, 6); n == 6 {
+						i += 1 + n
+					}
+				}
+			}
+		}
+		start = i
+	}
+	if start < len(s) {
+		spans = append(spans, FormatSpan{Text: s[start:], Format: format})
+	}
+	return spans
+}
+
+func isFormatCode(r rune) bool {
+	switch r {
+	case FormatBold, FormatColor, FormatHexColor, FormatReset, FormatMonospace,
+		FormatReverse, FormatItalic, FormatStrikethrough, FormatUnderline:
+		return true
+	}
+	return false
+}
+
+// parseColor returns the prefix of s of up to max chars that satisfy valid,
+// and its length.
+func parseColor(s string, valid func(byte) bool, max int) (string, int) {
+	n := 0
+	for n < max && n < len(s) && valid(s[n]) {
+		n++
+	}
+	return s[:n], n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
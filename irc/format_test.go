@@ -0,0 +1,66 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStripFormatting(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"plain text", "plain text"},
+		{"", ""},
+		{"\x02bold\x02 and \x1ditalic\x1d", "bold and italic"},
+		{"\x1funder\x1e strike\x11mono\x16rev\x0f", "under strikemonorev"},
+		{"\x034red\x03 \x0304,12red on blue\x03", "red red on blue"},
+		{"\x03123", "3"},
+		{"\x034,5,6", ",6"},
+		{"\x034,", ","},
+		{"\x03,4", ",4"},
+		{"\x03", ""},
+		{"\x04FF0000red\x04", "red"},
+		{"\x04ff0000,00FF00both", "both"},
+		{"\x04FF00short", "FF00short"},
+		{"\x04FF0000,00FFshort", ",00FFshort"},
+		{"caf\x02é\x02", "café"},
+	}
+	for _, test := range tests {
+		if got := StripFormatting(test.in); got != test.want {
+			t.Errorf("StripFormatting(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseFormatting(t *testing.T) {
+	plain := Format{Fg: -1, Bg: -1}
+	bold := plain
+	bold.Bold = true
+	boldItalic := bold
+	boldItalic.Italic = true
+	red := plain
+	red.Fg = 4
+	redOnBlue := red
+	redOnBlue.Bg = 12
+	all := Format{true, true, true, true, true, true, 4, 12}
+
+	tests := []struct {
+		in   string
+		want []FormatSpan
+	}{
+		{"", nil},
+		{"plain", []FormatSpan{{"plain", plain}}},
+		{"\x02\x02", nil},
+		{"a\x02b\x1dc\x02\x1dd", []FormatSpan{{"a", plain}, {"b", bold}, {"c", boldItalic}, {"d", plain}}},
+		{"\x02bold\x0fplain", []FormatSpan{{"bold", bold}, {"plain", plain}}},
+		{"\x034red\x03plain", []FormatSpan{{"red", red}, {"plain", plain}}},
+		{"\x0304,12x\x034y", []FormatSpan{{"x", redOnBlue}, {"y", redOnBlue}}},
+		{"\x0304,12x\x0399,12y", []FormatSpan{{"x", redOnBlue}, {"y", Format{Fg: 99, Bg: 12}}}},
+		{"\x04FF0000x", []FormatSpan{{"x", plain}}},
+		{"\x0304,12\x04FF0000x", []FormatSpan{{"x", redOnBlue}}},
+		{"\x02\x1d\x1f\x1e\x11\x16\x034,12x", []FormatSpan{{"x", all}}},
+	}
+	for _, test := range tests {
+		if got := ParseFormatting(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseFormatting(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
@@ -2,27 +2,96 @@ package irc
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
 func (c *Conn) setupStateHandlers() {
-	c.stateRegistry.AddCallback("001", h_001)
-	c.stateRegistry.AddCallback("004", h_004)
+	// recorded first, so Welcome() includes the line being handled
+	c.stateRegistry.AddCallback(RPL_WELCOME, h_welcome)
+	c.stateRegistry.AddCallback(RPL_YOURHOST, h_welcome)
+	c.stateRegistry.AddCallback(RPL_CREATED, h_welcome)
+	c.stateRegistry.AddCallback(RPL_MYINFO, h_welcome)
+	c.stateRegistry.AddCallback(RPL_ISUPPORT, h_welcome)
+	c.stateRegistry.AddCallback(RPL_ENDOFMOTD, h_endOfMOTD)
+	c.stateRegistry.AddCallback(ERR_NOMOTD, h_endOfMOTD)
+
+	c.stateRegistry.AddCallback(RPL_WELCOME, h_001)
+	c.stateRegistry.AddCallback(RPL_MYINFO, h_004)
+	c.stateRegistry.AddCallback(RPL_ISUPPORT, h_005)
 
 	c.stateRegistry.AddCallback("PING", h_PING)
+	c.stateRegistry.AddCallback("PONG", h_PONG)
+	c.stateRegistry.AddCallback("ERROR", h_ERROR)
+	c.stateRegistry.AddCallback("CAP", h_CAP)
+	c.stateRegistry.AddCallback("BATCH", h_BATCH)
+	c.stateRegistry.AddCallback("TAGMSG", h_TAGMSG)
+	c.stateRegistry.AddCallback(ERR_UNKNOWNCOMMAND, h_421)
+	c.stateRegistry.AddCallback("AUTHENTICATE", h_AUTHENTICATE)
+	c.stateRegistry.AddCallback(ERR_NICKLOCKED, h_saslDone)
+	c.stateRegistry.AddCallback(RPL_SASLSUCCESS, h_saslDone)
+	c.stateRegistry.AddCallback(ERR_SASLFAIL, h_saslDone)
+	c.stateRegistry.AddCallback(ERR_SASLTOOLONG, h_saslDone)
+	c.stateRegistry.AddCallback(ERR_SASLABORTED, h_saslDone)
+	c.stateRegistry.AddCallback(ERR_SASLALREADY, h_saslDone)
 
 	c.stateRegistry.AddCallback("MODE", h_MODE)
 	c.stateRegistry.AddCallback("NICK", h_NICK)
+	c.stateRegistry.AddCallback("JOIN", h_JOIN)
+	c.stateRegistry.AddCallback("PART", h_PART)
+	c.stateRegistry.AddCallback("KICK", h_KICK)
+	c.stateRegistry.AddCallback("QUIT", h_QUIT)
+	c.stateRegistry.AddCallback("CHGHOST", h_CHGHOST)
+	c.stateRegistry.AddCallback("SETNAME", h_SETNAME)
+
+	c.stateRegistry.AddCallback(RPL_UMODEIS, h_221)
+	c.stateRegistry.AddCallback(RPL_UNAWAY, h_305)
+	c.stateRegistry.AddCallback(RPL_NOWAWAY, h_306)
+
+	c.stateRegistry.AddCallback(RPL_WHOISUSER, h_311)
+	c.stateRegistry.AddCallback(RPL_WHOISSERVER, h_312)
+	c.stateRegistry.AddCallback(RPL_WHOISOPERATOR, h_313)
+	c.stateRegistry.AddCallback(RPL_WHOISIDLE, h_317)
+	c.stateRegistry.AddCallback(RPL_ENDOFWHOIS, h_318)
+	c.stateRegistry.AddCallback(RPL_WHOISCHANNELS, h_319)
+	c.stateRegistry.AddCallback(RPL_WHOWASUSER, h_314)
+	c.stateRegistry.AddCallback(RPL_ENDOFWHOWAS, h_369)
+	c.stateRegistry.AddCallback(RPL_WHOREPLY, h_352)
+	c.stateRegistry.AddCallback(RPL_ENDOFWHO, h_315)
+	c.stateRegistry.AddCallback(RPL_NAMREPLY, h_353)
+	c.stateRegistry.AddCallback(RPL_ENDOFNAMES, h_366)
+	c.stateRegistry.AddCallback(RPL_MOTDSTART, h_375)
+	c.stateRegistry.AddCallback(RPL_MOTD, h_372)
+	c.stateRegistry.AddCallback(RPL_LIST, h_322)
+	c.stateRegistry.AddCallback(RPL_LISTEND, h_323)
+	c.stateRegistry.AddCallback(RPL_ISON, h_303)
+	c.stateRegistry.AddCallback(RPL_USERHOST, h_302)
+
+	c.stateRegistry.AddCallback(ERR_TOOMANYCHANNELS, h_joinFailed)
+	c.stateRegistry.AddCallback(ERR_CHANNELISFULL, h_joinFailed)
+	c.stateRegistry.AddCallback(ERR_INVITEONLYCHAN, h_joinFailed)
+	c.stateRegistry.AddCallback(ERR_BANNEDFROMCHAN, h_joinFailed)
+	c.stateRegistry.AddCallback(ERR_BADCHANNELKEY, h_joinFailed)
 
-	c.stateRegistry.AddCallback("431", h_431)
-	c.stateRegistry.AddCallback("432", h_432)
-	c.stateRegistry.AddCallback("433", h_433)
-	c.stateRegistry.AddCallback("436", h_436)
-	c.stateRegistry.AddCallback("437", h_437)
+	c.stateRegistry.AddCallback(RPL_MONONLINE, h_730)
+	c.stateRegistry.AddCallback(RPL_MONOFFLINE, h_731)
+	c.stateRegistry.AddCallback(RPL_LOGON, h_watch)
+	c.stateRegistry.AddCallback(RPL_LOGOFF, h_watch)
+	c.stateRegistry.AddCallback(RPL_NOWON, h_watch)
+	c.stateRegistry.AddCallback(RPL_NOWOFF, h_watch)
+
+	c.stateRegistry.AddCallback(ERR_NONICKNAMEGIVEN, h_431)
+	c.stateRegistry.AddCallback(ERR_ERRONEUSNICKNAME, h_432)
+	c.stateRegistry.AddCallback(ERR_NICKNAMEINUSE, h_433)
+	c.stateRegistry.AddCallback(ERR_NICKCOLLISION, h_436)
+	c.stateRegistry.AddCallback(ERR_UNAVAILRESOURCE, h_437)
 }
 
 func h_001(conn *Conn, line Line) {
 	// we successfully logged in
+	// if we're still negotiating capabilities, the server must not support it
+	conn.capNegotiating = false
 	if len(line.Args) > 0 {
 		conn.me.Nick = line.Args[0]
 	} else {
@@ -32,22 +101,166 @@ func h_001(conn *Conn, line Line) {
 }
 
 func h_004(conn *Conn, line Line) {
-	// login sequence complete
-	conn.safeConnState.registry.Dispatch(CONNECTED, conn)
+	// <me> <server> <version> <user modes> <channel modes> [<modes with param>]
+	if len(line.Args) > 4 {
+		info := ServerInfo{
+			Name:         line.Args[1],
+			Version:      line.Args[2],
+			UserModes:    line.Args[3],
+			ChannelModes: line.Args[4],
+		}
+		if len(line.Args) > 5 {
+			info.ChannelModesWithParam = line.Args[5]
+		}
+		conn.safeConnState.Lock()
+		conn.safeConnState.myinfo = info
+		conn.safeConnState.Unlock()
+	}
+	if !conn.afterMOTD {
+		conn.connect()
+	}
+}
+
+func h_welcome(conn *Conn, line Line) {
+	if !conn.motdDone {
+		conn.welcome = append(conn.welcome, line)
+	}
+}
+
+// RPL_ENDOFMOTD and ERR_NOMOTD
+func h_endOfMOTD(conn *Conn, line Line) {
+	motd := conn.motdPending
+	conn.motdPending = nil
+	if motd == nil || line.Command == ERR_NOMOTD {
+		motd = []string{}
+	}
+	conn.motd = motd
+	conn.dispatchReply(MOTD, line, nil, motdText(motd))
+	conn.motdDone = true
+	if conn.afterMOTD {
+		conn.connect()
+	}
+}
+
+// connect dispatches CONNECTED, once the login sequence is complete.
+func (c *Conn) connect() {
+	if !c.connected {
+		c.connected = true
+		c.safeConnState.dispatch(CONNECTED, c)
+	}
+}
+
+// MOTD returns the lines of the last message of the day the server sent, as
+// for Line.MOTD(), or nil if it hasn't sent one yet.
+func (c *Conn) MOTD() []string {
+	if c.motd == nil {
+		return nil
+	}
+	return append([]string{}, c.motd...)
+}
+
+// Welcome returns the registration numerics the server sent, RPL_WELCOME
+// (001) through RPL_ISUPPORT (005), in the order they were received. Numerics
+// received after the end of the MOTD aren't included.
+func (c *Conn) Welcome() []Line {
+	return append([]Line(nil), c.welcome...)
 }
 
 func h_PING(conn *Conn, line Line) {
 	if len(line.Args) > 0 {
 		conn.Raw(fmt.Sprintf("PONG :%s", line.Args[0]))
+	} else {
+		conn.Raw("PONG")
+	}
+}
+
+func h_PONG(conn *Conn, line Line) {
+	// PONG <server> :<token>
+	if len(line.Args) > 0 {
+		conn.safeConnState.pong(line.Args[len(line.Args)-1])
+	}
+}
+
+// startPing records the token of a PING about to be sent. It returns false
+// if the previous PING is still unanswered.
+func (s *safeConnState) startPing(token string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.ping != "" {
+		return false
+	}
+	s.ping = token
+	return true
+}
+
+// pong clears the outstanding PING if the token matches.
+func (s *safeConnState) pong(token string) {
+	s.Lock()
+	defer s.Unlock()
+	if token == s.ping {
+		s.ping = ""
 	}
 }
 
+func h_ERROR(conn *Conn, line Line) {
+	// the server is about to close the connection
+	var msg string
+	if len(line.Args) > 0 {
+		msg = line.Args[0]
+	}
+	conn.shutdown(ServerError(msg))
+}
+
 func h_MODE(conn *Conn, line Line) {
 	if len(line.Args) > 1 {
-		if parseUser(line.Args[0]).Nick == conn.me.Nick {
-			// TODO: track our own mode
+		if conn.fold(parseUser(line.Args[0]).Nick) == conn.fold(conn.me.Nick) {
+			conn.setUserModes(applyUserModes(conn.safeConnState.umodes, line.Args[1]))
+		} else if changes, ok := line.ModeChanges(); ok && conn.trackState {
+			conn.updateMemberModes(line.Args[0], changes)
+		}
+	}
+}
+
+// RPL_UMODEIS
+func h_221(conn *Conn, line Line) {
+	// <me> <modes>
+	if len(line.Args) > 1 {
+		conn.setUserModes(applyUserModes("", line.Args[1]))
+	}
+}
+
+func (c *Conn) setUserModes(modes string) {
+	c.safeConnState.Lock()
+	c.safeConnState.umodes = modes
+	c.safeConnState.Unlock()
+}
+
+// applyUserModes applies a mode change such as "+i-w" to the modes, and
+// returns the result in sorted order.
+func applyUserModes(modes, change string) string {
+	set := make(map[rune]bool)
+	for _, m := range modes {
+		set[m] = true
+	}
+	adding := true
+	for _, m := range change {
+		switch m {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		default:
+			set[m] = adding
+		}
+	}
+	var result []rune
+	for m, on := range set {
+		if on {
+			result = append(result, m)
 		}
 	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return string(result)
 }
 
 func h_NICK(conn *Conn, line Line) {
@@ -55,9 +268,26 @@ func h_NICK(conn *Conn, line Line) {
 		if line.SrcIsMe() {
 			conn.me.Nick = line.Args[0]
 		}
+		conn.renameMember(line.Src.Nick, line.Args[0])
 	}
 }
 
+// RPL_UNAWAY
+func h_305(conn *Conn, line Line) {
+	conn.setAway(false)
+}
+
+// RPL_NOWAWAY
+func h_306(conn *Conn, line Line) {
+	conn.setAway(true)
+}
+
+func (c *Conn) setAway(away bool) {
+	c.safeConnState.Lock()
+	c.safeConnState.away = away
+	c.safeConnState.Unlock()
+}
+
 // ERR_NONICKNAMEGIVEN
 func h_431(conn *Conn, line Line) {
 	h_badNick(conn, line, 431)
@@ -118,7 +348,18 @@ func defaultCTCPHandler(conn *Conn, line Line) {
 		conn.CTCPReply(line.Src.Nick, "PING", param)
 	case "TIME":
 		conn.CTCPReply(line.Src.Nick, "TIME", time.Now().Format(time.UnixDate))
-	case "VERSION":
-		conn.CTCPReply(line.Src.Nick, "VERSION", "go library kballard/goirc")
+	case "VERSION", "SOURCE", "USERINFO":
+		if reply := conn.ctcpInfo[line.Args[0]]; reply != "" {
+			conn.CTCPReply(line.Src.Nick, line.Args[0], reply)
+		}
+	case "CLIENTINFO":
+		supported := []string{"ACTION", "CLIENTINFO", "PING", "TIME"}
+		for command, reply := range conn.ctcpInfo {
+			if reply != "" {
+				supported = append(supported, command)
+			}
+		}
+		sort.Strings(supported)
+		conn.CTCPReply(line.Src.Nick, "CLIENTINFO", strings.Join(supported, " "))
 	}
 }
@@ -0,0 +1,44 @@
+package irc
+
+// IRCError is an error numeric sent by the server, in the 400-599 range,
+// such as ERR_NOSUCHNICK. Use errors.As to check the Code.
+type IRCError struct {
+	Code string // the numeric, such as ERR_NOSUCHNICK
+	// Target is the parameter the error is about, such as the nick or
+	// channel, or "" if there's none.
+	Target  string
+	Message string // the server's human-readable explanation
+}
+
+func (e *IRCError) Error() string {
+	msg := "irc: " + e.Code
+	if e.Target != "" {
+		msg += " " + e.Target
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// IRCError returns the error for an error numeric line.
+// The second return value is false if the line isn't an error numeric.
+func (l *Line) IRCError() (*IRCError, bool) {
+	if !isErrorNumeric(l.Command) {
+		return nil, false
+	}
+	// <me> [<target> ...] :<message>
+	e := &IRCError{Code: l.Command}
+	if len(l.Args) > 2 {
+		e.Target = l.Args[1]
+	}
+	if len(l.Args) > 1 {
+		e.Message = l.Args[len(l.Args)-1]
+	}
+	return e, true
+}
+
+func isErrorNumeric(command string) bool {
+	return len(command) == 3 && (command[0] == '4' || command[0] == '5') &&
+		command[1] >= '0' && command[1] <= '9' && command[2] >= '0' && command[2] <= '9'
+}
@@ -0,0 +1,123 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ISupport returns the RPL_ISUPPORT (005) tokens advertised by the server.
+// Tokens without a value map to the empty string. The returned map is a copy.
+func (c *Conn) ISupport() map[string]string {
+	return c.safeConnState.copyISupport()
+}
+
+func (s *safeConnState) copyISupport() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	m := make(map[string]string, len(s.isupport))
+	for k, v := range s.isupport {
+		m[k] = v
+	}
+	return m
+}
+
+// ServerInfo is the server's RPL_MYINFO (004) reply.
+type ServerInfo struct {
+	Name    string
+	Version string
+	// UserModes and ChannelModes are the mode letters the server supports.
+	UserModes    string
+	ChannelModes string
+	// ChannelModesWithParam are the channel modes that take a parameter, if
+	// the server sent them.
+	ChannelModesWithParam string
+}
+
+// ServerInfo returns the server's name, version, and supported modes, as sent
+// during login. The second return value is false if the server hasn't sent
+// them.
+func (c *Conn) ServerInfo() (ServerInfo, bool) {
+	// we're the only writer, so no lock is needed for reading
+	info := c.safeConnState.myinfo
+	return info, info.Name != ""
+}
+
+// isupportValue returns the value of the given ISUPPORT token.
+// It must only be called from the connection's goroutine.
+func (c *Conn) isupportValue(token string) (string, bool) {
+	// we're the only writer, so no lock is needed for reading
+	val, ok := c.safeConnState.isupport[token]
+	return val, ok
+}
+
+// isupportInt returns the integer value of the given ISUPPORT token, or 0 if
+// it's missing or malformed.
+func (c *Conn) isupportInt(token string) int {
+	if val, ok := c.isupportValue(token); ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// prefixes returns the channel status modes and their corresponding prefixes
+// from the PREFIX token, e.g. "ov" and "@+".
+func (c *Conn) prefixes() (modes, symbols string) {
+	if val, ok := c.isupportValue("PREFIX"); ok {
+		// (modes)symbols
+		if idx := strings.IndexByte(val, ')'); strings.HasPrefix(val, "(") && idx != -1 {
+			modes, symbols = val[1:idx], val[idx+1:]
+			if len(modes) == len(symbols) {
+				return
+			}
+		}
+	}
+	return "ov", "@+"
+}
+
+// RPL_ISUPPORT
+func h_005(conn *Conn, line Line) {
+	// <me> *( <token>[=<value>] / -<token> ) :are supported by this server
+	if len(line.Args) < 3 {
+		return
+	}
+	state := conn.safeConnState
+	state.Lock()
+	defer state.Unlock()
+	if state.isupport == nil {
+		state.isupport = make(map[string]string)
+	}
+	for _, token := range line.Args[1 : len(line.Args)-1] {
+		if strings.HasPrefix(token, "-") {
+			delete(state.isupport, token[1:])
+			continue
+		}
+		key, val := token, ""
+		if idx := strings.IndexByte(token, '='); idx != -1 {
+			key, val = token[:idx], unescapeISupport(token[idx+1:])
+		}
+		if key != "" {
+			state.isupport[key] = val
+		}
+	}
+}
+
+// unescapeISupport decodes the \xHH escapes allowed in ISUPPORT values.
+func unescapeISupport(val string) string {
+	if !strings.Contains(val, `\x`) {
+		return val
+	}
+	var buf []byte
+	for i := 0; i < len(val); i++ {
+		if val[i] == '\\' && i+3 < len(val) && val[i+1] == 'x' {
+			if b, err := strconv.ParseUint(val[i+2:i+4], 16, 8); err == nil {
+				buf = append(buf, byte(b))
+				i += 3
+				continue
+			}
+		}
+		buf = append(buf, val[i])
+	}
+	return string(buf)
+}
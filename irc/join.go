@@ -0,0 +1,46 @@
+package irc
+
+// JoinResult is the outcome of joining a channel.
+type JoinResult struct {
+	Channel string
+	// Code is the error numeric, such as ERR_BADCHANNELKEY or
+	// ERR_BANNEDFROMCHAN, or "" if the join succeeded.
+	Code string
+	// Reason is the server's explanation of the failure.
+	Reason string
+}
+
+// OK returns true if the join succeeded.
+func (r JoinResult) OK() bool {
+	return r.Code == ""
+}
+
+// Err returns the failure as an *IRCError, or nil if the join succeeded.
+func (r JoinResult) Err() error {
+	if r.OK() {
+		return nil
+	}
+	return &IRCError{Code: r.Code, Target: r.Channel, Message: r.Reason}
+}
+
+// JoinResult returns the result for a JOINRESULT line.
+// The second return value is false if the line isn't a JOINRESULT event.
+func (l *Line) JoinResult() (JoinResult, bool) {
+	result, ok := l.data.(JoinResult)
+	return result, ok
+}
+
+// h_joinFailed handles the numerics sent when a JOIN is refused:
+// ERR_TOOMANYCHANNELS, ERR_CHANNELISFULL, ERR_INVITEONLYCHAN,
+// ERR_BANNEDFROMCHAN, and ERR_BADCHANNELKEY.
+func h_joinFailed(conn *Conn, line Line) {
+	// <me> <channel> :<reason>
+	if len(line.Args) < 2 {
+		return
+	}
+	result := JoinResult{Channel: line.Args[1], Code: line.Command}
+	if len(line.Args) > 2 {
+		result.Reason = line.Args[2]
+	}
+	conn.dispatchReply(JOINRESULT, line, []string{result.Channel}, result)
+}
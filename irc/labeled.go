@@ -0,0 +1,133 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// labeledBatch is a batch of replies to a labeled command.
+type labeledBatch struct {
+	label  string
+	nested bool // a batch inside the labeled-response batch
+}
+
+// RawLabeled sends a raw line tagged with a unique label, using the IRCv3
+// labeled-response capability, and returns the label and a channel that
+// receives the server's replies to it. The channel is closed once the reply
+// is complete, or when the connection closes.
+// If the capability isn't enabled, the line is sent without a label, and the
+// returned label is empty and the channel already closed.
+func (c *Conn) RawLabeled(msg string) (string, <-chan Line) {
+	replies, queue := make(chan Line), make(chan Line)
+	go lineQueue(replies, queue)
+	if !c.HasCapability("labeled-response") {
+		c.Raw(msg)
+		close(queue)
+		return "", replies
+	}
+	label := c.safeConnState.nextLabel()
+	c.sendLabeled(label, msg, queue)
+	return label, replies
+}
+
+// nextLabel returns a label that's unique for the connection.
+func (s *safeConnState) nextLabel() string {
+	return "L" + strconv.FormatUint(s.labelSeq.Add(1), 36)
+}
+
+// sendLabeled records where to route the replies for the label, and sends
+// the line. It must be called on the connection's goroutine, so the replies
+// can't arrive before the route is recorded.
+func (c *Conn) sendLabeled(label, msg string, queue chan<- Line) {
+	if c.writerClosed {
+		close(queue)
+		return
+	}
+	if c.labels == nil {
+		c.labels = make(map[string]chan<- Line)
+		c.labelBatches = make(map[string]labeledBatch)
+	}
+	c.labels[label] = queue
+	c.send("@label=" + label + " " + filterMessage(firstLine(msg)))
+}
+
+// routeLabeled delivers the line to the RawLabeled caller it's a reply to,
+// if any. A reply is either a single line with the label tag, or a
+// labeled-response batch whose start line has the label tag.
+func (c *Conn) routeLabeled(line Line) {
+	if len(c.labels) == 0 {
+		return
+	}
+	if label, ok := line.Tags["label"]; ok {
+		queue, ok := c.labels[label]
+		if !ok {
+			return
+		}
+		if line.Command == "BATCH" && len(line.Args) > 1 && strings.HasPrefix(line.Args[0], "+") && line.Args[1] == "labeled-response" {
+			c.labelBatches[line.Args[0][1:]] = labeledBatch{label: label}
+			return
+		}
+		if line.Command != "ACK" {
+			// ACK means there's no reply at all
+			queue <- line
+		}
+		close(queue)
+		delete(c.labels, label)
+		return
+	}
+	batch, ok := c.labelBatches[line.BatchRef()]
+	if ok {
+		c.labels[batch.label] <- line
+		if line.Command == "BATCH" && len(line.Args) > 0 && strings.HasPrefix(line.Args[0], "+") {
+			c.labelBatches[line.Args[0][1:]] = labeledBatch{label: batch.label, nested: true}
+		}
+	}
+	if line.Command == "BATCH" && len(line.Args) > 0 && strings.HasPrefix(line.Args[0], "-") {
+		ref := line.Args[0][1:]
+		if batch, ok := c.labelBatches[ref]; ok {
+			delete(c.labelBatches, ref)
+			if !batch.nested {
+				close(c.labels[batch.label])
+				delete(c.labels, batch.label)
+			}
+		}
+	}
+}
+
+// closeLabels closes the channels of any outstanding RawLabeled calls.
+func (c *Conn) closeLabels() {
+	for label, queue := range c.labels {
+		close(queue)
+		delete(c.labels, label)
+	}
+}
+
+// lineQueue forwards lines from input to output without ever blocking the
+// sender, so the connection's goroutine can't be stalled by a slow reader.
+func lineQueue(output chan<- Line, input <-chan Line) {
+	var buf []Line
+loop:
+	for {
+		if len(buf) > 0 {
+			select {
+			case line, ok := <-input:
+				if !ok {
+					break loop
+				}
+				buf = append(buf, line)
+			case output <- buf[0]:
+				buf = buf[1:]
+			}
+		} else {
+			line, ok := <-input
+			if !ok {
+				break loop
+			}
+			buf = append(buf, line)
+		}
+	}
+	for _, line := range buf {
+		output <- line
+	}
+	close(output)
+}
@@ -0,0 +1,88 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readReplies returns the lines received on replies until it's closed.
+func readReplies(t *testing.T, replies <-chan Line) []string {
+	t.Helper()
+	var raws []string
+	for {
+		select {
+		case line, ok := <-replies:
+			if !ok {
+				return raws
+			}
+			raws = append(raws, line.Raw)
+		case <-time.After(time.Second):
+			t.Fatalf("replies weren't closed, got %q", raws)
+		}
+	}
+}
+
+func TestRawLabeled(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true, Capabilities: []string{"labeled-response", "batch"}})
+	s.registerCaps("labeled-response", "batch")
+	s.sync()
+
+	// a single line
+	label, replies := s.conn.RawLabeled("WHOIS bob")
+	s.expect("@label=" + label + " WHOIS bob")
+	s.send("@label="+label+" :srv 401 me bob :No such nick/channel", ":srv NOTICE me :unrelated")
+	if got, want := readReplies(t, replies), []string{"@label=" + label + " :srv 401 me bob :No such nick/channel"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("single reply = %q, want %q", got, want)
+	}
+
+	// a batch, with another batch nested in it
+	label, replies = s.conn.RawLabeled("WHO #chan")
+	s.expect("@label=" + label + " WHO #chan")
+	s.send("@label="+label+" :srv BATCH +r labeled-response",
+		"@batch=r :srv 352 me #chan u h srv a H :0 A",
+		":srv NOTICE me :unrelated",
+		"@batch=r :srv BATCH +n example",
+		"@batch=n :srv NOTICE me :nested",
+		":srv BATCH -n",
+		"@batch=r :srv 315 me #chan :End of WHO list",
+		":srv BATCH -r",
+		"@batch=r :srv NOTICE me :too late")
+	if got, want := readReplies(t, replies), []string{
+		"@batch=r :srv 352 me #chan u h srv a H :0 A",
+		"@batch=r :srv BATCH +n example",
+		"@batch=n :srv NOTICE me :nested",
+		"@batch=r :srv 315 me #chan :End of WHO list",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("batch reply = %q, want %q", got, want)
+	}
+
+	// no reply at all
+	label, replies = s.conn.RawLabeled("PONG :x")
+	s.expect("@label=" + label + " PONG :x")
+	s.send("@label=" + label + " :srv ACK")
+	if got := readReplies(t, replies); len(got) != 0 {
+		t.Errorf("ACK reply = %q", got)
+	}
+
+	// the connection closes before the reply
+	label, replies = s.conn.RawLabeled("WHOIS carol")
+	s.expect("@label=" + label + " WHOIS carol")
+	s.pipe.Close()
+	if got := readReplies(t, replies); len(got) != 0 {
+		t.Errorf("reply after closing = %q", got)
+	}
+}
+
+func TestRawLabeledWithoutCapability(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	s.register()
+	label, replies := s.conn.RawLabeled("WHOIS bob")
+	if label != "" {
+		t.Errorf("label = %q without labeled-response", label)
+	}
+	s.expect("WHOIS bob")
+	if got := readReplies(t, replies); len(got) != 0 {
+		t.Errorf("replies = %q", got)
+	}
+}
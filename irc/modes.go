@@ -0,0 +1,116 @@
+package irc
+
+import (
+	"strings"
+)
+
+// ModeChange is a single mode letter from a channel MODE line.
+type ModeChange struct {
+	Add  bool // false if the mode is being removed
+	Mode byte
+	// Arg is the parameter for the mode, such as the mask for +b or the nick
+	// for +o, or "" if the mode doesn't take one.
+	Arg string
+}
+
+// ModeChanges returns the parsed changes for a MODE line that targets a
+// channel. The modes are paired with their parameters using the CHANMODES
+// and PREFIX ISUPPORT tokens.
+// The second return value is false if the line isn't a channel MODE.
+func (l *Line) ModeChanges() ([]ModeChange, bool) {
+	changes, ok := l.data.([]ModeChange)
+	return changes, ok
+}
+
+// chanModes returns the CHANMODES token split into its four types: list
+// modes, modes that always take a parameter, modes that take a parameter only
+// when set, and modes that never take one.
+func (c *Conn) chanModes() (list, always, set, never string) {
+	val, ok := c.isupportValue("CHANMODES")
+	if !ok {
+		val = c.serverInfoChanModes()
+	}
+	types := strings.SplitN(val, ",", 5)
+	for len(types) < 4 {
+		types = append(types, "")
+	}
+	return types[0], types[1], types[2], types[3]
+}
+
+// chanTypes returns the CHANTYPES token, the prefixes for channel names.
+func (c *Conn) chanTypes() string {
+	chantypes, ok := c.isupportValue("CHANTYPES")
+	if !ok {
+		chantypes = "#&"
+	}
+	return chantypes
+}
+
+// serverInfoChanModes approximates the CHANMODES token from RPL_MYINFO, for
+// servers that haven't sent ISUPPORT. The well-known list modes and +l are
+// assumed to be what they usually are.
+func (c *Conn) serverInfoChanModes() string {
+	info := c.safeConnState.myinfo
+	if info.ChannelModesWithParam == "" {
+		return "beI,k,l,imnpst"
+	}
+	prefixModes, _ := c.prefixes()
+	var list, always, set, never []byte
+	for i := 0; i < len(info.ChannelModes); i++ {
+		mode := info.ChannelModes[i]
+		switch {
+		case strings.IndexByte(prefixModes, mode) != -1:
+			// handled separately
+		case strings.IndexByte(info.ChannelModesWithParam, mode) == -1:
+			never = append(never, mode)
+		case strings.IndexByte("beI", mode) != -1:
+			list = append(list, mode)
+		case mode == 'l':
+			set = append(set, mode)
+		default:
+			always = append(always, mode)
+		}
+	}
+	return string(list) + "," + string(always) + "," + string(set) + "," + string(never)
+}
+
+// isChannel returns whether the name starts with one of the CHANTYPES.
+func (c *Conn) isChannel(name string) bool {
+	return isChannelName(name, c.chanTypes())
+}
+
+func isChannelName(name, chantypes string) bool {
+	return name != "" && strings.IndexByte(chantypes, name[0]) != -1
+}
+
+// parseModeChanges pairs each mode letter in args[0] with its parameter from
+// the rest of args. Unknown modes are assumed to take no parameter.
+func (c *Conn) parseModeChanges(args []string) []ModeChange {
+	list, always, set, _ := c.chanModes()
+	prefixModes, _ := c.prefixes()
+	params := args[1:]
+	changes := []ModeChange{}
+	add := true
+	for i := 0; i < len(args[0]); i++ {
+		mode := args[0][i]
+		switch mode {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+		change := ModeChange{Add: add, Mode: mode}
+		takesArg := strings.IndexByte(list, mode) != -1 ||
+			strings.IndexByte(always, mode) != -1 ||
+			strings.IndexByte(prefixModes, mode) != -1 ||
+			(add && strings.IndexByte(set, mode) != -1)
+		if takesArg && len(params) > 0 {
+			change.Arg = params[0]
+			params = params[1:]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
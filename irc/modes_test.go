@@ -0,0 +1,84 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseModeChanges(t *testing.T) {
+	isupport := map[string]string{
+		"CHANMODES": "beI,kf,lj,imnpst",
+		"PREFIX":    "(qaohv)~&@%+",
+	}
+	tests := []struct {
+		args []string
+		want []ModeChange
+	}{
+		{[]string{"+nt"}, []ModeChange{{true, 'n', ""}, {true, 't', ""}}},
+		// A: list modes always take a parameter
+		{[]string{"+b-e", "*!*@a", "*!*@b"}, []ModeChange{{true, 'b', "*!*@a"}, {false, 'e', "*!*@b"}}},
+		// B: always a parameter, even when removed
+		{[]string{"+k-k", "key", "key"}, []ModeChange{{true, 'k', "key"}, {false, 'k', "key"}}},
+		// C: a parameter only when set
+		{[]string{"+l-l+i", "10"}, []ModeChange{{true, 'l', "10"}, {false, 'l', ""}, {true, 'i', ""}}},
+		{[]string{"-j+j", "3:5"}, []ModeChange{{false, 'j', ""}, {true, 'j', "3:5"}}},
+		// D: never a parameter
+		{[]string{"-m+s", "extra"}, []ModeChange{{false, 'm', ""}, {true, 's', ""}}},
+		// PREFIX modes take a nick
+		{[]string{"+qo-hv", "a", "b", "c", "d"}, []ModeChange{{true, 'q', "a"}, {true, 'o', "b"}, {false, 'h', "c"}, {false, 'v', "d"}}},
+		{[]string{"+ov-b+l", "nick", "nick", "*!*@h", "5"}, []ModeChange{{true, 'o', "nick"}, {true, 'v', "nick"}, {false, 'b', "*!*@h"}, {true, 'l', "5"}}},
+		// unknown modes take no parameter
+		{[]string{"+Zo", "nick"}, []ModeChange{{true, 'Z', ""}, {true, 'o', "nick"}}},
+		// missing parameters are left empty
+		{[]string{"+ob", "nick"}, []ModeChange{{true, 'o', "nick"}, {true, 'b', ""}}},
+		{[]string{"+"}, []ModeChange{}},
+	}
+	c := &Conn{safeConnState: &safeConnState{isupport: isupport}}
+	for _, test := range tests {
+		if got := c.parseModeChanges(test.args); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseModeChanges(%q) = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestParseModeChangesDefaults(t *testing.T) {
+	// without ISUPPORT, the usual modes are assumed
+	c := &Conn{safeConnState: &safeConnState{}}
+	got := c.parseModeChanges([]string{"+bklov-l", "*!*@h", "key", "5", "a", "b"})
+	want := []ModeChange{{true, 'b', "*!*@h"}, {true, 'k', "key"}, {true, 'l', "5"}, {true, 'o', "a"}, {true, 'v', "b"}, {false, 'l', ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseModeChanges = %v, want %v", got, want)
+	}
+
+	// RPL_MYINFO's modes with a parameter, without CHANMODES
+	c.safeConnState.myinfo = ServerInfo{ChannelModes: "beIklimnopstvq", ChannelModesWithParam: "beIkloqv"}
+	c.safeConnState.isupport = map[string]string{"PREFIX": "(qov)~@+"}
+	got = c.parseModeChanges([]string{"+qk-l+I", "a", "key", "*!*@h"})
+	want = []ModeChange{{true, 'q', "a"}, {true, 'k', "key"}, {false, 'l', ""}, {true, 'I', "*!*@h"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseModeChanges with RPL_MYINFO = %v, want %v", got, want)
+	}
+}
+
+func TestModeChangesLine(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	modes := make(chan []ModeChange, 2)
+	s.conn.AddHandler("MODE", func(_ *Conn, line Line) {
+		changes, ok := line.ModeChanges()
+		if !ok {
+			changes = nil
+		}
+		modes <- changes
+	})
+	s.register()
+	s.send(":srv 005 me CHANMODES=b,k,l,n PREFIX=(ov)@+ :are supported by this server",
+		":op!o@h MODE #chan +ol-n nick 5",
+		":me!m@h MODE me +i")
+	s.sync()
+	if got, want := <-modes, []ModeChange{{true, 'o', "nick"}, {true, 'l', "5"}, {false, 'n', ""}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("channel MODE changes = %v, want %v", got, want)
+	}
+	if got := <-modes; got != nil {
+		t.Errorf("user MODE has changes %v", got)
+	}
+}
@@ -0,0 +1,146 @@
+package irc
+
+import (
+	"strings"
+)
+
+// MonitorStatus is the online status of a monitored nick.
+type MonitorStatus struct {
+	// User contains only the Nick when the user is offline. When online, it
+	// contains the user and host if the server provided them.
+	User   User
+	Online bool
+}
+
+// MonitorStatus returns the status for a MONITOR line.
+// The second return value is false if the line isn't a MONITOR event.
+func (l *Line) MonitorStatus() (MonitorStatus, bool) {
+	status, ok := l.data.(MonitorStatus)
+	return status, ok
+}
+
+// Monitor adds nicks to, and removes nicks from, the server-side list of
+// nicks whose online status we're notified about. This uses the MONITOR
+// command, or WATCH if the server only advertises that.
+// The server reports the current status of added nicks immediately, and
+// every change after that, as MONITOR events.
+func (c *Conn) Monitor(add, remove []string) {
+	_, watch := c.isupportValue("WATCH")
+	if _, ok := c.isupportValue("MONITOR"); ok {
+		watch = false
+	}
+	if len(remove) > 0 {
+		c.safeConnState.Lock()
+		for _, nick := range remove {
+			delete(c.safeConnState.monitor, c.fold(nick))
+		}
+		c.safeConnState.Unlock()
+	}
+	for _, line := range composeMonitor(add, remove, watch) {
+		c.send(line)
+	}
+}
+
+// MonitorStatus returns the last known online status of each monitored nick,
+// keyed by nick. Nicks the server hasn't reported on yet are omitted.
+func (c *Conn) MonitorStatus() map[string]bool {
+	return c.safeConnState.copyMonitor()
+}
+
+func (s *safeConnState) copyMonitor() map[string]bool {
+	s.RLock()
+	defer s.RUnlock()
+	m := make(map[string]bool, len(s.monitor))
+	for _, status := range s.monitor {
+		m[status.User.Nick] = status.Online
+	}
+	return m
+}
+
+func composeMonitor(add, remove []string, watch bool) []string {
+	clean := func(nicks []string) []string {
+		var out []string
+		for _, nick := range nicks {
+			if nick = strings.SplitN(firstWord(nick), ",", 2)[0]; nick != "" {
+				out = append(out, nick)
+			}
+		}
+		return out
+	}
+	add, remove = clean(add), clean(remove)
+	var lines []string
+	if watch {
+		// WATCH -nick +nick
+		var args []string
+		for _, nick := range remove {
+			args = append(args, "-"+nick)
+		}
+		for _, nick := range add {
+			args = append(args, "+"+nick)
+		}
+		if len(args) > 0 {
+			lines = append(lines, filterMessage("WATCH "+strings.Join(args, " ")))
+		}
+		return lines
+	}
+	if len(remove) > 0 {
+		lines = append(lines, filterMessage("MONITOR - "+strings.Join(remove, ",")))
+	}
+	if len(add) > 0 {
+		lines = append(lines, filterMessage("MONITOR + "+strings.Join(add, ",")))
+	}
+	return lines
+}
+
+// setMonitorStatus records the status and dispatches a MONITOR event.
+func (c *Conn) setMonitorStatus(line Line, status MonitorStatus) {
+	c.safeConnState.Lock()
+	if c.safeConnState.monitor == nil {
+		c.safeConnState.monitor = make(map[string]MonitorStatus)
+	}
+	c.safeConnState.monitor[c.fold(status.User.Nick)] = status
+	c.safeConnState.Unlock()
+	c.dispatchReply(MONITOR, line, []string{status.User.Nick}, status)
+}
+
+// RPL_MONONLINE
+func h_730(conn *Conn, line Line) {
+	// <me> :nick!user@host *( "," nick!user@host )
+	if len(line.Args) > 1 {
+		for _, target := range strings.Split(line.Args[1], ",") {
+			if user := parseUser(target); user.Nick != "" {
+				conn.setMonitorStatus(line, MonitorStatus{User: user, Online: true})
+			}
+		}
+	}
+}
+
+// RPL_MONOFFLINE
+func h_731(conn *Conn, line Line) {
+	// <me> :nick *( "," nick )
+	if len(line.Args) > 1 {
+		for _, target := range strings.Split(line.Args[1], ",") {
+			if user := parseUser(target); user.Nick != "" {
+				conn.setMonitorStatus(line, MonitorStatus{User: User{Nick: user.Nick}})
+			}
+		}
+	}
+}
+
+// RPL_LOGON, RPL_LOGOFF, RPL_NOWON, and RPL_NOWOFF
+func h_watch(conn *Conn, line Line) {
+	// <me> <nick> <user> <host> <time> :<text>
+	if len(line.Args) < 4 {
+		return
+	}
+	status := MonitorStatus{
+		User:   User{Nick: line.Args[1]},
+		Online: line.Command == RPL_LOGON || line.Command == RPL_NOWON,
+	}
+	if status.Online {
+		status.User.User = line.Args[2]
+		status.User.Host = line.Args[3]
+		status.User.Raw = status.User.Nick + "!" + status.User.User + "@" + status.User.Host
+	}
+	conn.setMonitorStatus(line, status)
+}
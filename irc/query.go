@@ -0,0 +1,109 @@
+package irc
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrConnClosed is returned when the connection closed before the
+	// operation could complete.
+	ErrConnClosed = errors.New("irc: connection closed")
+	// ErrTimeout is returned when the server didn't reply in time.
+	ErrTimeout = errors.New("irc: timed out waiting for reply")
+	// ErrNoSuchNick is returned when the queried nick isn't online.
+	ErrNoSuchNick = errors.New("irc: no such nick")
+)
+
+func (c *safeConn) WhoisSync(nick string, timeout time.Duration) (WhoisReply, error) {
+	// the waiter is recorded, and the WHOIS sent, on the connection's
+	// goroutine, so the reply can't arrive first
+	results := make(chan whoisResult, 1)
+	waiter := &whoisWaiter{results: results}
+	if !c.Invoke(func(conn *Conn) {
+		conn.addWhoisWaiter(nick, waiter)
+		conn.Whois(nick)
+	}) {
+		return WhoisReply{}, ErrConnClosed
+	}
+	defer c.Invoke(func(conn *Conn) { conn.removeWhoisWaiter(waiter) })
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return res.reply, res.err
+	case <-timer.C:
+		return WhoisReply{}, ErrTimeout
+	case <-c.state.done():
+		return WhoisReply{}, ErrConnClosed
+	}
+}
+
+type whoisResult struct {
+	reply WhoisReply
+	err   error
+}
+
+// whoisWaiter is a WhoisSync call waiting for its reply.
+type whoisWaiter struct {
+	key      string // the case-folded nick
+	results  chan<- whoisResult
+	notFound bool // ERR_NOSUCHNICK was received
+}
+
+func (c *Conn) addWhoisWaiter(nick string, w *whoisWaiter) {
+	if c.whoisWaiters == nil {
+		c.whoisWaiters = make(map[string][]*whoisWaiter)
+	}
+	w.key = c.fold(nick)
+	c.whoisWaiters[w.key] = append(c.whoisWaiters[w.key], w)
+}
+
+func (c *Conn) removeWhoisWaiter(w *whoisWaiter) {
+	waiters := c.whoisWaiters[w.key]
+	for i, other := range waiters {
+		if other == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(c.whoisWaiters, w.key)
+	} else {
+		c.whoisWaiters[w.key] = waiters
+	}
+}
+
+// routeWhois delivers the reply to the WhoisSync calls waiting for it. This
+// runs before the line is dispatched, so it doesn't affect the handlers.
+func (c *Conn) routeWhois(line Line) {
+	if len(c.whoisWaiters) == 0 || len(line.Args) < 2 {
+		return
+	}
+	key := c.fold(line.Args[1])
+	switch line.Command {
+	case ERR_NOSUCHNICK:
+		// <me> <nick> :No such nick/channel
+		// the server follows this with RPL_ENDOFWHOIS, so the error is
+		// remembered until then
+		for _, w := range c.whoisWaiters[key] {
+			w.notFound = true
+		}
+	case RPL_ENDOFWHOIS:
+		// <me> <nick> :End of WHOIS list
+		// the earlier replies have been collected by their handlers
+		reply := WhoisReply{User: User{Nick: line.Args[1]}}
+		if pending := c.whois[key]; pending != nil {
+			reply = *pending
+		}
+		for _, w := range c.whoisWaiters[key] {
+			if w.notFound {
+				w.results <- whoisResult{err: ErrNoSuchNick}
+			} else {
+				w.results <- whoisResult{reply: reply}
+			}
+		}
+		delete(c.whoisWaiters, key)
+	}
+}
@@ -0,0 +1,81 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWhoisSync(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	unknown := make(chan Line, 1)
+	s.conn.AddHandler(UNKNOWN, func(_ *Conn, line Line) { unknown <- line })
+	s.register()
+	s.sync()
+
+	type result struct {
+		reply WhoisReply
+		err   error
+	}
+	whoisSync := func(nick string) <-chan result {
+		results := make(chan result, 1)
+		go func() {
+			reply, err := s.conn.WhoisSync(nick, time.Second)
+			results <- result{reply, err}
+		}()
+		return results
+	}
+
+	results := whoisSync("Bob")
+	s.expect("WHOIS Bob")
+	if got, want := s.conn.Handlers(), map[string]int{UNKNOWN: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Handlers() during WhoisSync = %v, want %v", got, want)
+	}
+	// removing the user's handlers doesn't affect WhoisSync
+	s.conn.RemoveHandlers(WHOIS)
+	s.conn.RemoveHandlers(ERR_NOSUCHNICK)
+	s.send(":srv 311 me bob b host * :Bob Smith",
+		":srv 318 me bob :End of WHOIS list")
+	res := <-results
+	if res.err != nil || res.reply.User.Host != "host" || res.reply.RealName != "Bob Smith" {
+		t.Errorf("WhoisSync = %+v, %v", res.reply, res.err)
+	}
+
+	results = whoisSync("nobody")
+	s.expect("WHOIS nobody")
+	s.send(":srv 401 me nobody :No such nick/channel",
+		":srv 318 me nobody :End of WHOIS list")
+	if res := <-results; res.err != ErrNoSuchNick {
+		t.Errorf("WhoisSync for a missing nick returned %v, want ErrNoSuchNick", res.err)
+	}
+	select {
+	case line := <-unknown:
+		if line.Command != ERR_NOSUCHNICK {
+			t.Errorf("UNKNOWN got %q", line.Raw)
+		}
+	case <-time.After(time.Second):
+		t.Error("ERR_NOSUCHNICK wasn't dispatched to UNKNOWN")
+	}
+
+	s.sync()
+	done := make(chan int)
+	s.conn.Invoke(func(c *Conn) { done <- len(c.whoisWaiters) })
+	if n := <-done; n != 0 {
+		t.Errorf("%d WhoisSync waiters left", n)
+	}
+}
+
+func TestWhoisSyncTimeout(t *testing.T) {
+	s := newTestServer(t, Config{AllowFlood: true})
+	s.register()
+	if _, err := s.conn.WhoisSync("bob", 10*time.Millisecond); err != ErrTimeout {
+		t.Errorf("WhoisSync returned %v, want ErrTimeout", err)
+	}
+	s.expect("WHOIS bob")
+	s.sync()
+	done := make(chan int)
+	s.conn.Invoke(func(c *Conn) { done <- len(c.whoisWaiters) })
+	if n := <-done; n != 0 {
+		t.Errorf("%d WhoisSync waiters left after the timeout", n)
+	}
+}
@@ -0,0 +1,81 @@
+package irc
+
+import "sync/atomic"
+
+// queueCount counts the lines waiting in connWriter, to enforce
+// Config.MaxQueue. Senders count their lines before sending them, and
+// connWriter uncounts them once they're written or discarded. A new one is
+// made for each connection.
+type queueCount struct {
+	n      atomic.Int64
+	max    int64
+	policy QueuePolicy
+	room   chan struct{} // signaled when lines are uncounted
+}
+
+func newQueueCount(max int, policy QueuePolicy) *queueCount {
+	return &queueCount{max: int64(max), policy: policy, room: make(chan struct{}, 1)}
+}
+
+func (q *queueCount) len() int {
+	return int(q.n.Load())
+}
+
+// full returns whether lines would be dropped for exceeding MaxQueue with
+// QueueDropNewest.
+func (q *queueCount) full() bool {
+	return q.max > 0 && q.policy == QueueDropNewest && q.n.Load() >= q.max
+}
+
+// add counts lines that aren't limited, such as priority lines.
+func (q *queueCount) add(n int) {
+	q.n.Add(int64(n))
+}
+
+// remove uncounts lines that were written or discarded.
+func (q *queueCount) remove(n int) {
+	q.n.Add(-int64(n))
+	q.wake()
+}
+
+// wake wakes a sender waiting in reserve, if any.
+func (q *queueCount) wake() {
+	select {
+	case q.room <- struct{}{}:
+	default:
+	}
+}
+
+// reserve counts n normal lines that are about to be sent, if they fit. With
+// QueueDropNewest, it returns false if they don't all fit. With QueueBlock,
+// it waits for room, and returns false if closed is closed first. A batch
+// larger than MaxQueue is let through once the queue is empty, rather than
+// waiting forever.
+func (q *queueCount) reserve(n int, closed <-chan struct{}) bool {
+	if q.max == 0 || q.policy == QueueDropOldest {
+		// connWriter discards the oldest lines itself
+		q.add(n)
+		return true
+	}
+	for {
+		cur := q.n.Load()
+		if cur+int64(n) <= q.max || (q.policy == QueueBlock && cur == 0) {
+			if !q.n.CompareAndSwap(cur, cur+int64(n)) {
+				continue
+			}
+			if cur+int64(n) < q.max {
+				// there's room left for another waiting sender
+				q.wake()
+			}
+			return true
+		}
+		if q.policy == QueueDropNewest {
+			return false
+		}
+		select {
+		case <-q.room:
+		case <-closed:
+			return false
+		}
+	}
+}
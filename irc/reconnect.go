@@ -0,0 +1,66 @@
+package irc
+
+import (
+	"errors"
+)
+
+// ErrConnected is returned by Reconnect if the connection is still open.
+var ErrConnected = errors.New("irc: still connected")
+
+func (c *safeConn) Reconnect() error {
+	s := c.state
+	s.Lock()
+	if s.live {
+		s.Unlock()
+		return ErrConnected
+	}
+	// claim the connection, so concurrent calls fail
+	s.live = true
+	s.Unlock()
+
+	config := s.config
+	nc, err := dialServer(s.ctx, s.server, config.LocalAddr, config.Timeout, config.SSL, config.StartTLS, config.SSLConfig)
+	s.Lock()
+	if err == nil && s.closing {
+		// Close was called while dialing
+		nc.Close()
+		err = ErrConnClosed
+	}
+	if err != nil {
+		s.live = false
+		s.closing = false
+		s.Unlock()
+		return err
+	}
+	s.Unlock()
+	s.stats.reconnects.Add(1)
+	startConn(s.ctx, nc, s.server, config, s)
+	return nil
+}
+
+// reset clears the state from any previous connection.
+func (s *safeConnState) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = make(chan struct{})
+	s.live = true
+	s.lastErr = nil
+	// a fresh counter, as the previous connection's writer may still be
+	// discarding its lines
+	s.queued = newQueueCount(s.config.MaxQueue, s.config.QueuePolicy)
+	s.myinfo = ServerInfo{}
+	s.isupport = nil
+	s.caps = nil
+	s.away = false
+	s.ping = ""
+	s.umodes = ""
+	s.monitor = nil
+}
+
+// done returns a channel that's closed when the current connection shuts
+// down.
+func (s *safeConnState) done() <-chan struct{} {
+	s.RLock()
+	defer s.RUnlock()
+	return s.closed
+}
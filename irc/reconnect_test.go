@@ -0,0 +1,71 @@
+package irc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseDuringReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// keep the accepted connections open until the listener closes
+		var accepted []net.Conn
+		defer func() {
+			for _, c := range accepted {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted = append(accepted, c)
+		}
+	}()
+	var conn SafeConn
+	connects := 0
+	disconnected := make(chan bool, 2)
+	conn, err = Connect(Config{
+		Host: "127.0.0.1",
+		Port: uint(ln.Addr().(*net.TCPAddr).Port),
+		Nick: "me",
+		OnConnect: func(net.Conn) {
+			// the second time, close before the new net.Conn is recorded
+			if connects++; connects == 2 && !conn.Close() {
+				t.Error("Close() during Reconnect returned false")
+			}
+		},
+		Init: func(hr HandlerRegistry) {
+			hr.AddHandler(DISCONNECTED, func(*Conn, Line) { disconnected <- true })
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnect := func() {
+		t.Helper()
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Fatal("not disconnected")
+		}
+	}
+	conn.Close()
+	waitDisconnect()
+	if err := conn.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnect()
+	if conn.Connected() {
+		t.Error("Connected() is true after Close")
+	}
+	if err := conn.LastError(); err != nil {
+		t.Errorf("LastError() is %v after Close", err)
+	}
+}
@@ -0,0 +1,49 @@
+package irc
+
+// Redaction is a message deletion, received as a REDACT command.
+type Redaction struct {
+	Target string // where the message was sent
+	MsgID  string // the msgid of the deleted message
+	Reason string
+}
+
+// Redaction returns the deletion for a REDACT line.
+// The second return value is false if the line isn't a REDACT command.
+func (l *Line) Redaction() (Redaction, bool) {
+	redaction, ok := l.data.(Redaction)
+	return redaction, ok
+}
+
+// Delete deletes the message with the given msgid, as returned by
+// Line.MsgID(), using the draft/message-redaction capability. The target is
+// where the message was sent, and the reason is optional. Servers usually
+// only allow deleting our own messages, or others' as a channel operator.
+// Returns ErrNoCapability if the capability isn't enabled.
+func (c *Conn) Delete(target, msgid, reason string) error {
+	if !c.HasCapability("draft/message-redaction") {
+		return ErrNoCapability
+	}
+	c.send(composeRedact(target, msgid, reason))
+	return nil
+}
+
+// parseRedaction parses the args of a REDACT command.
+func parseRedaction(args []string) (Redaction, bool) {
+	// REDACT <target> <msgid> [:<reason>]
+	if len(args) < 2 {
+		return Redaction{}, false
+	}
+	redaction := Redaction{Target: args[0], MsgID: args[1]}
+	if len(args) > 2 {
+		redaction.Reason = args[2]
+	}
+	return redaction, true
+}
+
+func composeRedact(target, msgid, reason string) string {
+	line := "REDACT " + firstWord(target) + " " + firstWord(msgid)
+	if reason = firstLine(reason); reason != "" {
+		line += " :" + reason
+	}
+	return filterMessage(line)
+}
@@ -0,0 +1,133 @@
+package irc
+
+import (
+	"github.com/kballard/gocallback/callback"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// priorityEvent returns the name under which handlers with a non-zero
+// priority are registered.
+func priorityEvent(event string, priority int) string {
+	return event + "\x00" + strconv.Itoa(priority)
+}
+
+// addHandler registers the handler under the given registry event, and
+// records it under the event it was added for, for removeHandlers.
+func (s *safeConnState) addHandler(event, registryEvent string, f interface{}) callback.CallbackIdentifier {
+	ident := s.registry.AddCallback(registryEvent, f)
+	s.Lock()
+	if s.handlers == nil {
+		s.handlers = make(map[callback.CallbackIdentifier]string)
+	}
+	s.handlers[ident] = event
+	s.Unlock()
+	return ident
+}
+
+func (s *safeConnState) removeHandler(ident callback.CallbackIdentifier) {
+	s.registry.RemoveCallback(ident)
+	s.Lock()
+	delete(s.handlers, ident)
+	s.Unlock()
+}
+
+// removeHandlers removes every handler added for the event, at any priority.
+func (s *safeConnState) removeHandlers(event string) {
+	var idents []callback.CallbackIdentifier
+	s.Lock()
+	for ident, e := range s.handlers {
+		if e == event {
+			idents = append(idents, ident)
+			delete(s.handlers, ident)
+		}
+	}
+	s.Unlock()
+	for _, ident := range idents {
+		s.removeHandler(ident)
+	}
+}
+
+func (s *safeConnState) addHandlerPriority(event string, priority int, f func(*Conn, Line)) callback.CallbackIdentifier {
+	if priority == 0 {
+		return s.addHandler(event, event, f)
+	}
+	s.Lock()
+	if s.priorities == nil {
+		s.priorities = make(map[string][]int)
+	}
+	prios := s.priorities[event]
+	idx := sort.SearchInts(prios, priority)
+	if idx == len(prios) || prios[idx] != priority {
+		prios = append(prios, 0)
+		copy(prios[idx+1:], prios[idx:])
+		prios[idx] = priority
+		s.priorities[event] = prios
+	}
+	s.Unlock()
+	return s.addHandler(event, priorityEvent(event, priority), f)
+}
+
+// dispatch invokes the handlers for the event in priority order.
+// It returns whether any handlers were invoked.
+func (s *safeConnState) dispatch(event string, args ...interface{}) bool {
+	s.RLock()
+	prios := s.priorities[event]
+	s.RUnlock()
+	handled := false
+	ranDefault := false
+	for _, p := range prios {
+		if p > 0 && !ranDefault {
+			handled = s.registry.Dispatch(event, args...) || handled
+			ranDefault = true
+		}
+		handled = s.registry.Dispatch(priorityEvent(event, p), args...) || handled
+	}
+	if !ranDefault {
+		handled = s.registry.Dispatch(event, args...) || handled
+	}
+	return handled
+}
+
+// addHandlerOnce adds a handler that removes itself after its first
+// invocation. The handler may be dispatched before AddCallback returns, so
+// whichever of the two happens last removes it.
+func (s *safeConnState) addHandlerOnce(event string, f func(*Conn, Line)) callback.CallbackIdentifier {
+	var mu sync.Mutex
+	var ident callback.CallbackIdentifier
+	var added, fired bool
+	ident = s.addHandler(event, event, func(conn *Conn, line Line) {
+		mu.Lock()
+		if fired {
+			mu.Unlock()
+			return
+		}
+		fired = true
+		remove := added
+		mu.Unlock()
+		if remove {
+			s.removeHandler(ident)
+		}
+		f(conn, line)
+	})
+	mu.Lock()
+	added = true
+	remove := fired
+	mu.Unlock()
+	if remove {
+		s.removeHandler(ident)
+	}
+	return ident
+}
+
+// handlerCounts returns the number of handlers added for each event.
+func (s *safeConnState) handlerCounts() map[string]int {
+	s.RLock()
+	defer s.RUnlock()
+	counts := make(map[string]int)
+	for _, event := range s.handlers {
+		counts[event]++
+	}
+	return counts
+}
@@ -0,0 +1,449 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WhoisReply is the aggregated result of a WHOIS query.
+type WhoisReply struct {
+	User       User // Raw is empty, as the server doesn't send a prefix
+	RealName   string
+	Server     string
+	ServerInfo string
+	Operator   bool
+	Idle       time.Duration
+	SignOn     time.Time // zero if the server didn't provide it
+	// Channels contains the channel names as sent by the server, including
+	// any status prefixes such as @ or +.
+	Channels []string
+}
+
+// WhowasReply is a single entry from a WHOWAS query, describing a past user
+// of the nick.
+type WhowasReply struct {
+	User     User // Raw is empty, as the server doesn't send a prefix
+	RealName string
+	Server   string
+	// ServerInfo is usually the time the user signed off, as text.
+	ServerInfo string
+}
+
+// WhoReply is a single entry from a WHO query.
+type WhoReply struct {
+	Channel  string
+	User     User // Raw is empty, as the server doesn't send a prefix
+	Server   string
+	Away     bool
+	Operator bool
+	// Status contains any channel status prefixes, such as @ or +.
+	Status   string
+	Hops     int
+	RealName string
+}
+
+// ChannelMember is a single entry from a NAMES reply.
+type ChannelMember struct {
+	// User contains only the Nick, unless the userhost-in-names capability
+	// is enabled.
+	User User
+	// Prefix contains the channel status prefixes, such as "@+", from the
+	// highest rank to the lowest. With the multi-prefix capability, which
+	// is requested when Config.TrackState is set, this may contain more than
+	// one prefix; otherwise it has at most the highest.
+	Prefix string
+	// Modes contains the mode letters corresponding to Prefix, such as "ov".
+	Modes string
+}
+
+// HasMode returns whether the member has the given channel status mode, such
+// as 'o' or 'v'.
+func (m ChannelMember) HasMode(mode byte) bool {
+	return strings.IndexByte(m.Modes, mode) != -1
+}
+
+// UserhostReply is a single entry from a USERHOST reply.
+type UserhostReply struct {
+	User     User // Raw is empty, as the server doesn't send a prefix
+	Operator bool
+	Away     bool
+}
+
+// ListEntry is a single channel from a LIST reply.
+type ListEntry struct {
+	Channel string
+	Users   int
+	Topic   string
+}
+
+// Whois returns the aggregated reply for a WHOIS line.
+// The second return value is false if the line isn't a WHOIS event.
+func (l *Line) Whois() (WhoisReply, bool) {
+	reply, ok := l.data.(*WhoisReply)
+	if !ok {
+		return WhoisReply{}, false
+	}
+	return *reply, true
+}
+
+// Whowas returns the aggregated reply for a WHOWAS line. The reply is empty
+// if the server has no record of the nick.
+// The second return value is false if the line isn't a WHOWAS event.
+func (l *Line) Whowas() ([]WhowasReply, bool) {
+	reply, ok := l.data.([]WhowasReply)
+	return reply, ok
+}
+
+// Who returns the aggregated reply for a WHO line.
+// The second return value is false if the line isn't a WHO event.
+func (l *Line) Who() ([]WhoReply, bool) {
+	reply, ok := l.data.([]WhoReply)
+	return reply, ok
+}
+
+// Names returns the aggregated reply for a NAMES line.
+// The second return value is false if the line isn't a NAMES event.
+func (l *Line) Names() ([]ChannelMember, bool) {
+	reply, ok := l.data.([]ChannelMember)
+	return reply, ok
+}
+
+// ListEntry returns the parsed entry for a LIST line.
+// The second return value is false if the line isn't a LIST event.
+func (l *Line) ListEntry() (ListEntry, bool) {
+	entry, ok := l.data.(ListEntry)
+	return entry, ok
+}
+
+// MOTD returns the lines of the message of the day for a MOTD line, without
+// the leading "- ". It's empty if the server has no MOTD.
+// The second return value is false if the line isn't a MOTD event.
+func (l *Line) MOTD() ([]string, bool) {
+	text, ok := l.data.(motdText)
+	return text, ok
+}
+
+// motdText distinguishes the data of a MOTD line from other []string.
+type motdText []string
+
+// Ison returns the online nicks for an ISON line.
+// The second return value is false if the line isn't an ISON event.
+func (l *Line) Ison() ([]string, bool) {
+	nicks, ok := l.data.([]string)
+	return nicks, ok
+}
+
+// Userhost returns the parsed reply for a USERHOST line.
+// The second return value is false if the line isn't a USERHOST event.
+func (l *Line) Userhost() ([]UserhostReply, bool) {
+	reply, ok := l.data.([]UserhostReply)
+	return reply, ok
+}
+
+// pendingWhois returns the in-progress WHOIS reply for the nick, creating it
+// if necessary. Replies are keyed by nick so interleaved queries don't mix.
+func (c *Conn) pendingWhois(nick string) *WhoisReply {
+	if c.whois == nil {
+		c.whois = make(map[string]*WhoisReply)
+	}
+	key := c.fold(nick)
+	reply := c.whois[key]
+	if reply == nil {
+		reply = &WhoisReply{User: User{Nick: nick}}
+		c.whois[key] = reply
+	}
+	return reply
+}
+
+// RPL_WHOISUSER
+func h_311(conn *Conn, line Line) {
+	// <me> <nick> <user> <host> * :<real name>
+	if len(line.Args) > 5 {
+		reply := conn.pendingWhois(line.Args[1])
+		reply.User.User = line.Args[2]
+		reply.User.Host = line.Args[3]
+		reply.RealName = line.Args[5]
+	}
+}
+
+// RPL_WHOISSERVER
+func h_312(conn *Conn, line Line) {
+	// <me> <nick> <server> :<server info>
+	if len(line.Args) > 3 {
+		key := conn.fold(line.Args[1])
+		if entries := conn.whowas[key]; len(entries) > 0 && conn.whois[key] == nil {
+			// this is part of a WHOWAS reply, and describes the last entry
+			entry := &entries[len(entries)-1]
+			entry.Server = line.Args[2]
+			entry.ServerInfo = line.Args[3]
+			return
+		}
+		reply := conn.pendingWhois(line.Args[1])
+		reply.Server = line.Args[2]
+		reply.ServerInfo = line.Args[3]
+	}
+}
+
+// RPL_WHOISOPERATOR
+func h_313(conn *Conn, line Line) {
+	// <me> <nick> :is an IRC operator
+	if len(line.Args) > 1 {
+		conn.pendingWhois(line.Args[1]).Operator = true
+	}
+}
+
+// RPL_WHOISIDLE
+func h_317(conn *Conn, line Line) {
+	// <me> <nick> <idle> [<signon>] :seconds idle
+	if len(line.Args) > 3 {
+		reply := conn.pendingWhois(line.Args[1])
+		if idle, err := strconv.ParseInt(line.Args[2], 10, 64); err == nil {
+			reply.Idle = time.Duration(idle) * time.Second
+		}
+		if len(line.Args) > 4 {
+			if signon, err := strconv.ParseInt(line.Args[3], 10, 64); err == nil {
+				reply.SignOn = time.Unix(signon, 0)
+			}
+		}
+	}
+}
+
+// RPL_ENDOFWHOIS
+func h_318(conn *Conn, line Line) {
+	// <me> <nick> :End of WHOIS list
+	if len(line.Args) > 1 {
+		nick := line.Args[1]
+		reply := conn.pendingWhois(nick)
+		delete(conn.whois, conn.fold(nick))
+		conn.dispatchReply(WHOIS, line, []string{nick}, reply)
+	}
+}
+
+// RPL_WHOISCHANNELS
+func h_319(conn *Conn, line Line) {
+	// <me> <nick> :*( ( "@" / "+" ) <channel> " " )
+	// this may be sent multiple times for long channel lists
+	if len(line.Args) > 2 {
+		reply := conn.pendingWhois(line.Args[1])
+		reply.Channels = append(reply.Channels, strings.Fields(line.Args[2])...)
+	}
+}
+
+// RPL_WHOWASUSER
+func h_314(conn *Conn, line Line) {
+	// <me> <nick> <user> <host> * :<real name>
+	if len(line.Args) > 5 {
+		if conn.whowas == nil {
+			conn.whowas = make(map[string][]WhowasReply)
+		}
+		key := conn.fold(line.Args[1])
+		conn.whowas[key] = append(conn.whowas[key], WhowasReply{
+			User:     User{Nick: line.Args[1], User: line.Args[2], Host: line.Args[3]},
+			RealName: line.Args[5],
+		})
+	}
+}
+
+// RPL_ENDOFWHOWAS
+func h_369(conn *Conn, line Line) {
+	// <me> <nick> :End of WHOWAS
+	if len(line.Args) > 1 {
+		nick := line.Args[1]
+		key := conn.fold(nick)
+		reply := conn.whowas[key]
+		delete(conn.whowas, key)
+		if reply == nil {
+			reply = []WhowasReply{}
+		}
+		conn.dispatchReply(WHOWAS, line, []string{nick}, reply)
+	}
+}
+
+// RPL_WHOREPLY
+func h_352(conn *Conn, line Line) {
+	// <me> <channel> <user> <host> <server> <nick> <H|G>[*][@|+] :<hops> <real name>
+	if len(line.Args) < 8 {
+		return
+	}
+	reply := WhoReply{
+		Channel: line.Args[1],
+		User: User{
+			Nick: line.Args[5],
+			User: line.Args[2],
+			Host: line.Args[3],
+		},
+		Server: line.Args[4],
+	}
+	flags := line.Args[6]
+	if strings.HasPrefix(flags, "G") {
+		reply.Away = true
+	}
+	if len(flags) > 0 {
+		flags = flags[1:]
+	}
+	if strings.HasPrefix(flags, "*") {
+		reply.Operator = true
+		flags = flags[1:]
+	}
+	reply.Status = flags
+	comps := strings.SplitN(line.Args[7], " ", 2)
+	reply.Hops, _ = strconv.Atoi(comps[0])
+	if len(comps) > 1 {
+		reply.RealName = comps[1]
+	}
+	// the channel field doesn't identify the query (a WHO for a nick may
+	// report any shared channel), but the server answers queries in order,
+	// so everything up to the next RPL_ENDOFWHO belongs together.
+	conn.who = append(conn.who, reply)
+}
+
+// RPL_ENDOFWHO
+func h_315(conn *Conn, line Line) {
+	// <me> <mask> :End of WHO list
+	if len(line.Args) > 1 {
+		replies := conn.who
+		conn.who = nil
+		conn.dispatchReply(WHO, line, []string{line.Args[1]}, replies)
+	}
+}
+
+// parseMember parses an entry from RPL_NAMREPLY, stripping the status
+// prefixes using the given modes and symbols from the PREFIX token.
+func parseMember(name, modes, symbols string) ChannelMember {
+	var member ChannelMember
+	for len(name) > 0 {
+		idx := strings.IndexByte(symbols, name[0])
+		if idx == -1 {
+			break
+		}
+		member.Prefix += name[:1]
+		member.Modes += modes[idx : idx+1]
+		name = name[1:]
+	}
+	member.User = parseUser(name)
+	if member.User.Nick == "" {
+		// not a valid nick, but don't throw it away
+		member.User = User{Nick: name, Raw: name}
+	}
+	return member
+}
+
+// RPL_NAMREPLY
+func h_353(conn *Conn, line Line) {
+	// <me> <=|*|@> <channel> :[prefix]<nick> *( " " [prefix]<nick> )
+	if len(line.Args) < 4 {
+		return
+	}
+	channel := line.Args[2]
+	modes, symbols := conn.prefixes()
+	if conn.names == nil {
+		conn.names = make(map[string][]ChannelMember)
+	}
+	key := conn.fold(channel)
+	for _, name := range strings.Fields(line.Args[3]) {
+		conn.names[key] = append(conn.names[key], parseMember(name, modes, symbols))
+	}
+}
+
+// RPL_ENDOFNAMES
+func h_366(conn *Conn, line Line) {
+	// <me> <channel> :End of NAMES list
+	if len(line.Args) > 1 {
+		channel := line.Args[1]
+		key := conn.fold(channel)
+		members := conn.names[key]
+		delete(conn.names, key)
+		if members == nil {
+			members = []ChannelMember{}
+		}
+		conn.updateMembers(channel, members)
+		conn.dispatchReply(NAMES, line, []string{channel}, members)
+	}
+}
+
+// RPL_MOTDSTART
+func h_375(conn *Conn, line Line) {
+	conn.motdPending = []string{}
+}
+
+// RPL_MOTD
+func h_372(conn *Conn, line Line) {
+	// <me> :- <text>
+	if len(line.Args) > 1 {
+		text := line.Args[1]
+		if text == "-" {
+			text = ""
+		}
+		conn.motdPending = append(conn.motdPending, strings.TrimPrefix(text, "- "))
+	}
+}
+
+// RPL_LIST
+func h_322(conn *Conn, line Line) {
+	// <me> <channel> <# visible> :<topic>
+	if len(line.Args) > 3 {
+		entry := ListEntry{Channel: line.Args[1], Topic: line.Args[3]}
+		entry.Users, _ = strconv.Atoi(line.Args[2])
+		conn.dispatchReply(LIST, line, []string{entry.Channel}, entry)
+	}
+}
+
+// RPL_LISTEND
+func h_323(conn *Conn, line Line) {
+	conn.dispatchReply(LISTEND, line, nil, nil)
+}
+
+// RPL_USERHOST
+func h_302(conn *Conn, line Line) {
+	// <me> :*( <nick>[*]=<+|-><user>@<host> " " )
+	if len(line.Args) < 2 {
+		return
+	}
+	replies := []UserhostReply{}
+	nicks := []string{}
+	for _, entry := range strings.Fields(line.Args[1]) {
+		idx := strings.IndexByte(entry, '=')
+		if idx == -1 || idx+1 == len(entry) {
+			continue
+		}
+		var reply UserhostReply
+		nick, host := entry[:idx], entry[idx+1:]
+		if strings.HasSuffix(nick, "*") {
+			reply.Operator = true
+			nick = nick[:len(nick)-1]
+		}
+		reply.Away = host[0] == '-'
+		host = host[1:]
+		reply.User.Nick = nick
+		if at := strings.IndexByte(host, '@'); at != -1 {
+			reply.User.User, reply.User.Host = host[:at], host[at+1:]
+		} else {
+			reply.User.Host = host
+		}
+		replies = append(replies, reply)
+		nicks = append(nicks, nick)
+	}
+	conn.dispatchReply(USERHOST, line, nicks, replies)
+}
+
+// RPL_ISON
+func h_303(conn *Conn, line Line) {
+	// <me> :*( <nick> " " )
+	if len(line.Args) > 1 {
+		nicks := strings.Fields(line.Args[1])
+		if nicks == nil {
+			nicks = []string{}
+		}
+		conn.dispatchReply(ISON, line, nicks, nicks)
+	}
+}
+
+// dispatchReply dispatches a synthesized event carrying an aggregated reply.
+// The synthesized Line is based on the line that terminated the reply.
+func (c *Conn) dispatchReply(event string, line Line, args []string, data interface{}) {
+	line.Command = event
+	line.Args = args
+	line.data = data
+	c.safeConnState.dispatch(event, c, line)
+}
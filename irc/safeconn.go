@@ -1,8 +1,15 @@
 package irc
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"github.com/kballard/gocallback/callback"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // SafeConn is a set of methods that may be called from any goroutine. They
@@ -10,14 +17,72 @@ import (
 // return value is false if the connection was already closed, or true if the
 // write succeeded (note: this does not mean the server successfully received
 // the message).
+//
+// Every method on Conn that sends a message to the server has a counterpart
+// here, so routine sends never need to go through Invoke.
 type SafeConn interface {
 	// Me returns the user at the time the SafeConn was created
 	Me() User
 	// Server returns the host:port pair that identifies the server
 	Server() string
+	// RemoteAddr is the same as Conn.RemoteAddr
+	RemoteAddr() net.Addr
+	// LocalAddr is the same as Conn.LocalAddr
+	LocalAddr() net.Addr
+	// ConnectionState is the same as Conn.ConnectionState
+	ConnectionState() (tls.ConnectionState, bool)
 
 	// Connected returns whether the connection is still connected
 	Connected() bool
+	// LastError is the same as Conn.LastError
+	LastError() error
+	// QueueLen is the same as Conn.QueueLen
+	QueueLen() int
+	// Stats is the same as Conn.Stats
+	Stats() Stats
+	// Drain is the same as Conn.Drain
+	Drain() bool
+	// Close forcibly terminates the connection, like Conn.Shutdown, but
+	// without going through Invoke, so it works even after Drain. It
+	// returns without waiting for the DISCONNECTED handlers, so it's also
+	// safe to call from the connection's goroutine. During a Reconnect, it
+	// aborts the reconnection.
+	Close() bool
+	// QuitAndWait sends a QUIT and blocks until the server closes the
+	// connection, so the quit message is seen before the process exits. If
+	// the timeout elapses first, the connection is shut down. Returns true if
+	// the server closed the connection in time.
+	// This must not be called from the connection's goroutine.
+	QuitAndWait(msg string, timeout time.Duration) bool
+
+	// ISupport is the same as Conn.ISupport
+	ISupport() map[string]string
+	// ServerInfo is the same as Conn.ServerInfo
+	ServerInfo() (ServerInfo, bool)
+	// Capabilities is the same as Conn.Capabilities
+	Capabilities() []string
+	// HasCapability is the same as Conn.HasCapability
+	HasCapability(name string) bool
+	// IsAway is the same as Conn.IsAway
+	IsAway() bool
+	// UserModes is the same as Conn.UserModes
+	UserModes() string
+	// MonitorStatus is the same as Conn.MonitorStatus
+	MonitorStatus() map[string]bool
+
+	// WhoisSync sends a WHOIS and blocks until the reply arrives, returning
+	// ErrNoSuchNick if the nick isn't online, ErrTimeout if the timeout
+	// elapses first, or ErrConnClosed if the connection closes first.
+	// This must not be called from the connection's goroutine.
+	WhoisSync(nick string, timeout time.Duration) (WhoisReply, error)
+
+	// Reconnect dials the server again with the original Config and logs in,
+	// after the connection has closed. The existing handlers are kept, and
+	// Config.Init is not called again. Returns ErrConnected if the connection
+	// is still open. It may be called from a DISCONNECTED handler. If the
+	// connection was made with ConnectContext, the same context is used.
+	// Returns ErrConnClosed if Close is called while dialing.
+	Reconnect() error
 
 	// Invoke runs the given function on the connection's goroutine
 	Invoke(func(*Conn)) bool
@@ -25,20 +90,78 @@ type SafeConn interface {
 	// AddHandler is the same as Conn.AddHandler
 	AddHandler(name string, f func(*Conn, Line)) callback.CallbackIdentifier
 
+	// AddHandlerPriority is the same as Conn.AddHandlerPriority
+	AddHandlerPriority(name string, priority int, f func(*Conn, Line)) callback.CallbackIdentifier
+
+	// AddHandlerOnce is the same as Conn.AddHandlerOnce
+	AddHandlerOnce(name string, f func(*Conn, Line)) callback.CallbackIdentifier
+
 	// RemoveHandler is the same as Conn.RemoveHandler
 	RemoveHandler(callback.CallbackIdentifier)
 
+	// RemoveHandlers is the same as Conn.RemoveHandlers
+	RemoveHandlers(name string)
+
+	// Handlers is the same as Conn.Handlers
+	Handlers() map[string]int
+
 	// Conn methods
 	Raw(line string) bool
+	Rawf(format string, args ...interface{}) bool
+	RawUnsafe(line string) bool
+	RawLabeled(msg string) (label string, replies <-chan Line)
+	Send(command string, args ...string) error
 	Privmsg(dst, msg string) bool
+	PrivmsgMulti(targets []string, msg string) bool
+	PrivmsgTagged(dst, msg string, tags map[string]string) error
+	Typing(target, state string) error
+	React(target, msgid, reaction string) error
+	Delete(target, msgid, reason string) error
+	Reply(line Line, msg string) bool
+	PrivmsgStatus(prefix byte, channel, msg string) error
+	NoticeStatus(prefix byte, channel, msg string) error
+	PrivmsgSplit(dst, msg string) bool
 	Action(dst, msg string) bool
 	Notice(dst, msg string) bool
+	NoticeSplit(dst, msg string) bool
 	CTCP(dst, command, args string) bool
 	CTCPReply(dst, command, args string) bool
+	SendDCC(dst string, offer DCCOffer) bool
 	Quit(msg string) bool
 	Nick(newnick string) bool
+	SetName(realname string) bool
 	Join(channels, keys []string) bool
+	JoinKeys(channels map[string]string) bool
 	Part(channels []string, msg string) bool
+	PartChannel(channel, reason string) bool
+	Topic(channel, topic string) bool
+	Kick(channel, nick, reason string) bool
+	Mode(target string, modes ...string) bool
+	KickBan(channel, nick, banmask, reason string) bool
+	Whois(nick string) bool
+	Whowas(nick string, count int) bool
+	Who(mask string) bool
+	Names(channel string) bool
+	List(params ...string) bool
+	Ison(nicks ...string) bool
+	Userhost(nicks ...string) bool
+	Invite(nick, channel string) bool
+	Oper(name, password string) bool
+	Wallops(msg string) bool
+	Monitor(add, remove []string) bool
+	ChatHistoryLatest(target, ref string, limit int) bool
+	ChatHistoryBefore(target, ref string, limit int) bool
+	ChatHistoryAfter(target, ref string, limit int) bool
+	ChatHistoryBetween(target, start, end string, limit int) bool
+	Away(msg string) bool
+	Back() bool
+
+	// Variants of the above that return ErrConnClosed instead of false, and
+	// nil instead of true.
+	RawErr(line string) error
+	PrivmsgErr(dst, msg string) error
+	ActionErr(dst, msg string) error
+	NoticeErr(dst, msg string) error
 }
 
 type safeConn struct {
@@ -50,9 +173,34 @@ type safeConnState struct {
 	sync.RWMutex
 	writer  chan<- string
 	invoker chan<- func(*Conn)
+	netconn net.Conn
+	closing bool // set by Close, so the resulting read error isn't reported
 
-	server   string
-	registry *callback.Registry
+	server     string
+	ctx        context.Context // for reconnecting
+	config     Config
+	registry   *callback.Registry
+	priorities map[string][]int                       // sorted non-zero handler priorities by event
+	handlers   map[callback.CallbackIdentifier]string // the event of each handler
+	closed     chan struct{}                          // closed on shutdown, replaced on reconnect
+	live       bool                                   // true until the connection is shut down
+	lastErr    error
+	queued     *queueCount // lines waiting in connWriter, replaced on reconnect
+	labelSeq   atomic.Uint64
+	stats      connStats
+
+	// auto-away state
+	lastActive atomic.Int64 // UnixNano of the last PRIVMSG or ACTION
+	autoAway   atomic.Bool  // true if we marked ourselves away
+
+	// only written from the connection's goroutine
+	myinfo   ServerInfo
+	isupport map[string]string
+	caps     map[string]bool
+	away     bool
+	ping     string // the token of the unanswered PING, if any
+	umodes   string
+	monitor  map[string]MonitorStatus // keyed by case-folded nick
 }
 
 // SafeConn returns a SafeConn object that can be passed to another goroutine.
@@ -73,7 +221,124 @@ func (c *safeConn) Server() string {
 	return c.state.server
 }
 
-func (c *safeConn) exec(f func()) bool {
+func (c *safeConn) RemoteAddr() net.Addr {
+	c.state.RLock()
+	defer c.state.RUnlock()
+	if c.state.netconn == nil {
+		return nil
+	}
+	return c.state.netconn.RemoteAddr()
+}
+
+func (c *safeConn) LocalAddr() net.Addr {
+	c.state.RLock()
+	defer c.state.RUnlock()
+	if c.state.netconn == nil {
+		return nil
+	}
+	return c.state.netconn.LocalAddr()
+}
+
+func (c *safeConn) ConnectionState() (tls.ConnectionState, bool) {
+	c.state.RLock()
+	defer c.state.RUnlock()
+	return tlsState(c.state.netconn)
+}
+
+func (c *safeConn) ServerInfo() (ServerInfo, bool) {
+	c.state.RLock()
+	defer c.state.RUnlock()
+	info := c.state.myinfo
+	return info, info.Name != ""
+}
+
+func (c *safeConn) ISupport() map[string]string {
+	return c.state.copyISupport()
+}
+
+func (c *safeConn) Capabilities() []string {
+	return c.state.copyCaps()
+}
+
+func (c *safeConn) HasCapability(name string) bool {
+	return c.state.hasCap(name)
+}
+
+func (c *safeConn) IsAway() bool {
+	c.state.RLock()
+	defer c.state.RUnlock()
+	return c.state.away
+}
+
+func (c *safeConn) UserModes() string {
+	c.state.RLock()
+	defer c.state.RUnlock()
+	return c.state.umodes
+}
+
+func (c *safeConn) MonitorStatus() map[string]bool {
+	return c.state.copyMonitor()
+}
+
+// exec runs f, which calls send with the lines to send, and then sends them
+// if the connection is open. The lines are counted against MaxQueue all
+// together, so with QueueDropNewest either all of them are sent or none
+// are, and with QueueBlock this waits for room for all of them. The wait
+// happens without the lock, so the connection isn't held up.
+func (c *safeConn) exec(f func(send func(string))) bool {
+	c.state.RLock()
+	queued, closed := c.state.queued, c.state.closed
+	if c.state.writer == nil || queued.full() {
+		c.state.RUnlock()
+		return false
+	}
+	var lines []string
+	f(func(line string) { lines = append(lines, line) })
+	c.state.RUnlock()
+
+	normal := 0
+	for _, line := range lines {
+		if !isPriority(line, c.state.config.PriorityQuit) {
+			normal++
+		}
+	}
+	if !queued.reserve(normal, closed) {
+		return false
+	}
+	queued.add(len(lines) - normal)
+
+	c.state.RLock()
+	defer c.state.RUnlock()
+	if c.state.writer == nil || c.state.queued != queued {
+		// closed while waiting
+		queued.remove(len(lines))
+		return false
+	}
+	for _, line := range lines {
+		c.state.writer <- line
+	}
+	return true
+}
+
+// execCap is like exec, but returns ErrNoCapability without running f if the
+// capability isn't enabled.
+func (c *safeConn) execCap(name string, f func(send func(string))) error {
+	var err error
+	ok := c.exec(func(send func(string)) {
+		if !c.state.caps[name] {
+			err = ErrNoCapability
+			return
+		}
+		f(send)
+	})
+	if !ok {
+		return ErrConnClosed
+	}
+	return err
+}
+
+// open runs f if the connection is open, regardless of the queue.
+func (c *safeConn) open(f func()) bool {
 	c.state.RLock()
 	defer c.state.RUnlock()
 	if c.state.writer != nil {
@@ -84,83 +349,507 @@ func (c *safeConn) exec(f func()) bool {
 }
 
 func (c *safeConn) Connected() bool {
-	return c.exec(func() {})
+	return c.open(func() {})
+}
+
+func (c *safeConn) LastError() error {
+	c.state.RLock()
+	defer c.state.RUnlock()
+	return c.state.lastErr
+}
+
+func (c *safeConn) QueueLen() int {
+	c.state.RLock()
+	defer c.state.RUnlock()
+	return c.state.queued.len()
+}
+
+func (c *safeConn) Stats() Stats {
+	return c.state.stats.snapshot()
+}
+
+func (c *safeConn) Drain() bool {
+	return c.Invoke(func(conn *Conn) {
+		conn.Drain()
+	})
+}
+
+func (c *safeConn) Close() bool {
+	c.state.Lock()
+	defer c.state.Unlock()
+	if !c.state.live || c.state.closing {
+		return false
+	}
+	// closing the net.Conn unblocks connReader and connWriter, and runLoop
+	// then shuts down as usual. During a Reconnect, there may be no net.Conn
+	// yet, in which case Reconnect or startConn closes it once it's dialed.
+	c.state.closing = true
+	if c.state.netconn != nil {
+		c.state.netconn.Close()
+	}
+	return true
+}
+
+func (c *safeConn) QuitAndWait(msg string, timeout time.Duration) bool {
+	if !c.Quit(msg) {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	closed := c.state.done()
+	select {
+	case <-closed:
+		return true
+	case <-timer.C:
+	}
+	if c.Close() {
+		<-closed
+	}
+	return false
 }
 
 func (c *safeConn) Invoke(f func(*Conn)) bool {
-	return c.exec(func() {
+	return c.open(func() {
 		c.state.invoker <- f
 	})
 }
 
 func (c *safeConn) AddHandler(name string, f func(*Conn, Line)) callback.CallbackIdentifier {
-	return c.state.registry.AddCallback(name, f)
+	return c.state.addHandler(name, name, f)
+}
+
+func (c *safeConn) AddHandlerPriority(name string, priority int, f func(*Conn, Line)) callback.CallbackIdentifier {
+	return c.state.addHandlerPriority(name, priority, f)
+}
+
+func (c *safeConn) AddHandlerOnce(name string, f func(*Conn, Line)) callback.CallbackIdentifier {
+	return c.state.addHandlerOnce(name, f)
 }
 
 func (c *safeConn) RemoveHandler(ident callback.CallbackIdentifier) {
-	c.state.registry.RemoveCallback(ident)
+	c.state.removeHandler(ident)
+}
+
+func (c *safeConn) RemoveHandlers(name string) {
+	c.state.removeHandlers(name)
+}
+
+func (c *safeConn) Handlers() map[string]int {
+	return c.state.handlerCounts()
 }
 
 func (c *safeConn) Raw(msg string) bool {
-	return c.exec(func() {
-		c.state.writer <- filterMessage(firstLine(msg))
+	return c.exec(func(send func(string)) {
+		send(filterMessage(firstLine(msg)))
+	})
+}
+
+func (c *safeConn) RawUnsafe(line string) bool {
+	return c.exec(func(send func(string)) {
+		send(filterUnsafe(line))
 	})
 }
 
+func (c *safeConn) Rawf(format string, args ...interface{}) bool {
+	return c.Raw(fmt.Sprintf(format, args...))
+}
+
+func (c *safeConn) RawLabeled(msg string) (string, <-chan Line) {
+	replies, queue := make(chan Line), make(chan Line)
+	go lineQueue(replies, queue)
+	if !c.HasCapability("labeled-response") {
+		c.Raw(msg)
+		close(queue)
+		return "", replies
+	}
+	label := c.state.nextLabel()
+	// the route must be recorded on the connection's goroutine
+	if !c.Invoke(func(conn *Conn) { conn.sendLabeled(label, msg, queue) }) {
+		close(queue)
+	}
+	return label, replies
+}
+
+func (c *safeConn) Send(command string, args ...string) error {
+	line, err := composeSend(command, args)
+	if err != nil {
+		return err
+	}
+	return sendErr(c.exec(func(send func(string)) {
+		send(line)
+	}))
+}
+
 func (c *safeConn) Privmsg(dst, msg string) bool {
-	return c.exec(func() {
-		c.state.writer <- composePrivmsg(dst, msg)
+	return c.exec(func(send func(string)) {
+		if c.state.markActive() {
+			send(composeAway(""))
+		}
+		send(composePrivmsg(dst, msg))
+	})
+}
+
+func (c *safeConn) PrivmsgTagged(dst, msg string, tags map[string]string) error {
+	prefix := composeTags(tags)
+	var err error
+	ok := c.exec(func(send func(string)) {
+		if prefix != "" && !c.state.caps["message-tags"] {
+			err = ErrNoCapability
+			return
+		}
+		if c.state.markActive() {
+			send(composeAway(""))
+		}
+		send(prefix + composePrivmsg(dst, msg))
+	})
+	if !ok {
+		return ErrConnClosed
+	}
+	return err
+}
+
+func (c *safeConn) Typing(target, state string) error {
+	return c.execCap("message-tags", func(send func(string)) {
+		send(composeTagMsg(target, map[string]string{"+typing": state}))
+	})
+}
+
+func (c *safeConn) React(target, msgid, reaction string) error {
+	return c.execCap("message-tags", func(send func(string)) {
+		send(composeReact(target, msgid, reaction))
+	})
+}
+
+func (c *safeConn) Delete(target, msgid, reason string) error {
+	return c.execCap("draft/message-redaction", func(send func(string)) {
+		send(composeRedact(target, msgid, reason))
 	})
 }
 
+func (c *safeConn) Reply(line Line, msg string) bool {
+	return c.Privmsg(line.ReplyTarget(), msg)
+}
+
+func (c *safeConn) PrivmsgStatus(prefix byte, channel, msg string) error {
+	var err error
+	ok := c.exec(func(send func(string)) {
+		if !statusSupported(c.state.isupport, prefix) {
+			err = ErrStatusPrefix
+			return
+		}
+		if c.state.markActive() {
+			send(composeAway(""))
+		}
+		send(composePrivmsg(string(prefix)+channel, msg))
+	})
+	if !ok {
+		return ErrConnClosed
+	}
+	return err
+}
+
+func (c *safeConn) NoticeStatus(prefix byte, channel, msg string) error {
+	var err error
+	ok := c.exec(func(send func(string)) {
+		if !statusSupported(c.state.isupport, prefix) {
+			err = ErrStatusPrefix
+			return
+		}
+		send(composeNotice(string(prefix)+channel, msg))
+	})
+	if !ok {
+		return ErrConnClosed
+	}
+	return err
+}
+
+func (c *safeConn) PrivmsgMulti(targets []string, msg string) bool {
+	return c.exec(func(send func(string)) {
+		if len(targets) > 0 {
+			if c.state.markActive() {
+				send(composeAway(""))
+			}
+			send(composePrivmsgMulti(targets, msg))
+		}
+	})
+}
+
+func (c *safeConn) PrivmsgSplit(dst, msg string) bool {
+	return c.exec(func(send func(string)) {
+		if c.state.markActive() {
+			send(composeAway(""))
+		}
+		for _, line := range composePrivmsgSplit(dst, msg, c.splitReserve()) {
+			send(line)
+		}
+	})
+}
+
+// splitReserve returns the number of bytes to reserve for the source prefix
+// when splitting a message. c.me is a snapshot from when the SafeConn was
+// made, and the nick and host may have changed since, so room is reserved for
+// the longest nick NICKLEN allows, and the longest host. The caller must hold
+// the lock.
+func (c *safeConn) splitReserve() int {
+	me := c.me
+	me.Host = ""
+	reserve := sourceReserve(me)
+	nicklen, _ := strconv.Atoi(c.state.isupport["NICKLEN"])
+	if nicklen == 0 {
+		// not advertised. Few servers allow longer nicks than this
+		nicklen = 30
+	}
+	if nicklen > len(me.Nick) {
+		reserve += nicklen - len(me.Nick)
+	}
+	return reserve
+}
+
 func (c *safeConn) Action(dst, msg string) bool {
-	return c.exec(func() {
-		c.state.writer <- composeCTCP(dst, "ACTION", msg, false)
+	return c.exec(func(send func(string)) {
+		if c.state.markActive() {
+			send(composeAway(""))
+		}
+		send(composeCTCP(dst, "ACTION", msg, false))
 	})
 }
 
 func (c *safeConn) Notice(dst, msg string) bool {
-	return c.exec(func() {
-		c.state.writer <- composeNotice(dst, msg)
+	return c.exec(func(send func(string)) {
+		send(composeNotice(dst, msg))
+	})
+}
+
+func (c *safeConn) NoticeSplit(dst, msg string) bool {
+	return c.exec(func(send func(string)) {
+		for _, line := range composeNoticeSplit(dst, msg, c.splitReserve()) {
+			send(line)
+		}
 	})
 }
 
 func (c *safeConn) CTCP(dst, command, args string) bool {
-	return c.exec(func() {
-		c.state.writer <- composeCTCP(dst, command, args, false)
+	return c.exec(func(send func(string)) {
+		send(composeCTCP(dst, command, args, false))
 	})
 }
 
 func (c *safeConn) CTCPReply(dst, command, args string) bool {
-	return c.exec(func() {
-		c.state.writer <- composeCTCP(dst, command, args, true)
+	return c.exec(func(send func(string)) {
+		send(composeCTCP(dst, command, args, true))
+	})
+}
+
+func (c *safeConn) SendDCC(dst string, offer DCCOffer) bool {
+	return c.exec(func(send func(string)) {
+		if offer.Addr != nil {
+			send(composeDCC(dst, offer))
+		}
 	})
 }
 
 func (c *safeConn) Quit(msg string) bool {
-	return c.exec(func() {
-		c.state.writer <- composeQuit(msg)
+	return c.exec(func(send func(string)) {
+		send(composeQuit(msg))
 	})
 }
 
 func (c *safeConn) Nick(newnick string) bool {
-	return c.exec(func() {
-		c.state.writer <- composeNick(newnick)
+	return c.exec(func(send func(string)) {
+		// exec holds the read lock
+		nicklen, _ := strconv.Atoi(c.state.isupport["NICKLEN"])
+		send(composeNick(newnick, nicklen))
 	})
 }
 
 func (c *safeConn) Join(channels, keys []string) bool {
-	return c.exec(func() {
+	return c.exec(func(send func(string)) {
 		if len(channels) > 0 {
-			c.state.writer <- composeJoin(channels, keys)
+			send(composeJoin(channels, keys))
+		}
+	})
+}
+
+func (c *safeConn) JoinKeys(channels map[string]string) bool {
+	return c.exec(func(send func(string)) {
+		if len(channels) > 0 {
+			send(composeJoinKeys(channels))
 		}
 	})
 }
 
 func (c *safeConn) Part(channels []string, msg string) bool {
-	return c.exec(func() {
+	return c.exec(func(send func(string)) {
 		if len(channels) > 0 {
-			c.state.writer <- composePart(channels, msg)
+			send(composePart(channels, msg))
+		}
+	})
+}
+
+func (c *safeConn) PartChannel(channel, reason string) bool {
+	return c.exec(func(send func(string)) {
+		send(composePart([]string{channel}, reason))
+	})
+}
+
+func (c *safeConn) SetName(realname string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeSetName(realname))
+	})
+}
+
+func (c *safeConn) Topic(channel, topic string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeTopic(channel, topic))
+	})
+}
+
+func (c *safeConn) Kick(channel, nick, reason string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeKick(channel, nick, reason))
+	})
+}
+
+func (c *safeConn) Mode(target string, modes ...string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeMode(target, modes))
+	})
+}
+
+func (c *safeConn) KickBan(channel, nick, banmask, reason string) bool {
+	// the ban mask may come from the tracked state
+	return c.Invoke(func(conn *Conn) {
+		conn.KickBan(channel, nick, banmask, reason)
+	})
+}
+
+func (c *safeConn) Whois(nick string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeWhois(nick))
+	})
+}
+
+func (c *safeConn) Whowas(nick string, count int) bool {
+	return c.exec(func(send func(string)) {
+		send(composeWhowas(nick, count))
+	})
+}
+
+func (c *safeConn) Who(mask string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeWho(mask))
+	})
+}
+
+func (c *safeConn) Names(channel string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeNames(channel))
+	})
+}
+
+func (c *safeConn) List(params ...string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeList(params))
+	})
+}
+
+func (c *safeConn) Ison(nicks ...string) bool {
+	return c.exec(func(send func(string)) {
+		if len(nicks) > 0 {
+			send(composeIson(nicks))
 		}
 	})
 }
+
+func (c *safeConn) Userhost(nicks ...string) bool {
+	return c.exec(func(send func(string)) {
+		if len(nicks) > 0 {
+			send(composeUserhost(nicks))
+		}
+	})
+}
+
+func (c *safeConn) Invite(nick, channel string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeInvite(nick, channel))
+	})
+}
+
+func (c *safeConn) Oper(name, password string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeOper(name, password))
+	})
+}
+
+func (c *safeConn) Wallops(msg string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeWallops(msg))
+	})
+}
+
+func (c *safeConn) Monitor(add, remove []string) bool {
+	// this updates the monitor state, so it must run on the conn goroutine
+	return c.Invoke(func(conn *Conn) {
+		conn.Monitor(add, remove)
+	})
+}
+
+func (c *safeConn) ChatHistoryLatest(target, ref string, limit int) bool {
+	return c.exec(func(send func(string)) {
+		send(composeChatHistory("LATEST", target, limit, ref))
+	})
+}
+
+func (c *safeConn) ChatHistoryBefore(target, ref string, limit int) bool {
+	return c.exec(func(send func(string)) {
+		send(composeChatHistory("BEFORE", target, limit, ref))
+	})
+}
+
+func (c *safeConn) ChatHistoryAfter(target, ref string, limit int) bool {
+	return c.exec(func(send func(string)) {
+		send(composeChatHistory("AFTER", target, limit, ref))
+	})
+}
+
+func (c *safeConn) ChatHistoryBetween(target, start, end string, limit int) bool {
+	return c.exec(func(send func(string)) {
+		send(composeChatHistory("BETWEEN", target, limit, start, end))
+	})
+}
+
+func (c *safeConn) Away(msg string) bool {
+	return c.exec(func(send func(string)) {
+		send(composeAway(msg))
+	})
+}
+
+func (c *safeConn) Back() bool {
+	return c.exec(func(send func(string)) {
+		send(composeAway(""))
+	})
+}
+
+// sendErr converts the result of one of the bool-returning methods.
+func sendErr(ok bool) error {
+	if !ok {
+		return ErrConnClosed
+	}
+	return nil
+}
+
+func (c *safeConn) RawErr(line string) error {
+	return sendErr(c.Raw(line))
+}
+
+func (c *safeConn) PrivmsgErr(dst, msg string) error {
+	return sendErr(c.Privmsg(dst, msg))
+}
+
+func (c *safeConn) ActionErr(dst, msg string) error {
+	return sendErr(c.Action(dst, msg))
+}
+
+func (c *safeConn) NoticeErr(dst, msg string) error {
+	return sendErr(c.Notice(dst, msg))
+}
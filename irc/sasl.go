@@ -0,0 +1,80 @@
+package irc
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// SASL mechanisms for Config.SASLMechanism.
+const (
+	// SASLPlain authenticates with Config.SASLUser and Config.SASLPassword.
+	SASLPlain = "PLAIN"
+	// SASLExternal authenticates with the TLS client certificate from
+	// Config.SSLConfig, e.g. for CertFP.
+	SASLExternal = "EXTERNAL"
+)
+
+// saslChunk is the longest AUTHENTICATE payload that can be sent in one line.
+const saslChunk = 400
+
+// saslStart begins SASL authentication if it was configured and the server
+// acknowledged the sasl capability, and returns whether it did. Capability
+// negotiation is held open until authentication finishes.
+func (c *Conn) saslStart() bool {
+	if c.saslMech == "" || c.saslDone || !c.capNegotiating || !c.HasCapability("sasl") {
+		return false
+	}
+	// with CAP LS 302, the value lists the supported mechanisms
+	if mechs := c.capAvailable["sasl"]; mechs != "" {
+		found := false
+		for _, mech := range strings.Split(mechs, ",") {
+			if strings.EqualFold(mech, c.saslMech) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	c.saslDone = true
+	c.Raw("AUTHENTICATE " + c.saslMech)
+	return true
+}
+
+// saslPayload returns the response to the server's empty challenge.
+func (c *Conn) saslPayload() []byte {
+	switch c.saslMech {
+	case SASLPlain:
+		// authzid NUL authcid NUL password
+		return []byte(c.saslUser + "\x00" + c.saslUser + "\x00" + c.saslPassword)
+	default:
+		// EXTERNAL has no payload, the server uses the certificate
+		return nil
+	}
+}
+
+func h_AUTHENTICATE(conn *Conn, line Line) {
+	// AUTHENTICATE +
+	if len(line.Args) == 0 || line.Args[0] != "+" || !conn.capNegotiating {
+		return
+	}
+	payload := base64.StdEncoding.EncodeToString(conn.saslPayload())
+	for len(payload) >= saslChunk {
+		conn.Raw("AUTHENTICATE " + payload[:saslChunk])
+		payload = payload[saslChunk:]
+	}
+	if payload == "" {
+		// an empty payload, or one that's a multiple of the chunk size, is
+		// terminated with a lone +
+		payload = "+"
+	}
+	conn.Raw("AUTHENTICATE " + payload)
+}
+
+// RPL_SASLSUCCESS, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED,
+// ERR_SASLALREADY
+func h_saslDone(conn *Conn, line Line) {
+	// whether it succeeded or not, registration continues; the server
+	// decides whether an unauthenticated client is allowed on
+	conn.capEnd()
+}
@@ -0,0 +1,45 @@
+package irc
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidArg is returned by Send if the command or one of its arguments
+// can't be encoded in a line.
+var ErrInvalidArg = errors.New("irc: invalid command argument")
+
+// Send sends the command with the given arguments, formatting the line for
+// the caller. The last argument is prefixed with ':' if it's empty, contains
+// a space, or starts with ':'. Returns ErrInvalidArg, and sends nothing, if
+// an argument contains NUL, CR, or LF, or if any other argument would need
+// the ':' prefix.
+func (c *Conn) Send(command string, args ...string) error {
+	line, err := composeSend(command, args)
+	if err != nil {
+		return err
+	}
+	c.send(line)
+	return nil
+}
+
+func composeSend(command string, args []string) (string, error) {
+	if command == "" || strings.ContainsAny(command, " :\x00\r\n") {
+		return "", ErrInvalidArg
+	}
+	words := make([]string, 0, len(args)+1)
+	words = append(words, command)
+	for i, arg := range args {
+		if strings.ContainsAny(arg, "\x00\r\n") {
+			return "", ErrInvalidArg
+		}
+		if arg == "" || arg[0] == ':' || strings.IndexByte(arg, ' ') != -1 {
+			if i != len(args)-1 {
+				return "", ErrInvalidArg
+			}
+			arg = ":" + arg
+		}
+		words = append(words, arg)
+	}
+	return filterMessage(strings.Join(words, " ")), nil
+}
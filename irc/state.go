@@ -0,0 +1,278 @@
+package irc
+
+import (
+	"strings"
+)
+
+// Channel is the tracked state of a channel the client is in.
+// State is only tracked if Config.TrackState is set.
+type Channel struct {
+	Name string
+	// Members is keyed by the case-folded nick.
+	Members map[string]ChannelMember
+}
+
+// Channels returns the names of the tracked channels the client is in.
+func (c *Conn) Channels() []string {
+	names := make([]string, 0, len(c.channels))
+	for _, ch := range c.channels {
+		names = append(names, ch.Name)
+	}
+	return names
+}
+
+// Channel returns a copy of the tracked state for the named channel.
+// The second return value is false if the client isn't in the channel, or if
+// state tracking is disabled.
+func (c *Conn) Channel(name string) (Channel, bool) {
+	ch, ok := c.channels[c.fold(name)]
+	if !ok {
+		return Channel{}, false
+	}
+	copied := Channel{Name: ch.Name, Members: make(map[string]ChannelMember, len(ch.Members))}
+	for k, v := range ch.Members {
+		copied.Members[k] = v
+	}
+	return copied, true
+}
+
+// fold returns the case-folded form of a nick or channel name, for use as a
+// map key or in comparisons, using the server's CASEMAPPING.
+func (c *Conn) fold(name string) string {
+	return FoldCase(name, c.caseMapping())
+}
+
+// caseMapping returns the CASEMAPPING token. Servers that don't send it are
+// assumed to use rfc1459, as the RFCs specify.
+func (c *Conn) caseMapping() string {
+	if val, ok := c.isupportValue("CASEMAPPING"); ok {
+		return val
+	}
+	return "rfc1459"
+}
+
+// FoldCase returns the case-folded form of a nick or channel name under the
+// given CASEMAPPING, so two names are equal if their folded forms are.
+// "ascii" folds only A-Z. "rfc1459" also folds [\]^ to {|}~, which were
+// considered their lowercase forms, and "strict-rfc1459" does the same except
+// for ^. Any other mapping, such as "rfc7613", folds using Unicode case rules.
+func FoldCase(name, casemapping string) string {
+	var upper rune
+	switch casemapping {
+	case "ascii":
+		upper = 'Z'
+	case "rfc1459":
+		upper = '^'
+	case "strict-rfc1459":
+		upper = ']'
+	default:
+		return strings.ToLower(name)
+	}
+	return strings.Map(func(r rune) rune {
+		// [\]^ follow Z, just as {|}~ follow z
+		if r >= 'A' && r <= upper {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, name)
+}
+
+// trackedChannel returns the tracked channel, or nil if it's not tracked.
+func (c *Conn) trackedChannel(name string) *Channel {
+	if c.channels == nil {
+		return nil
+	}
+	return c.channels[c.fold(name)]
+}
+
+// banMask returns a ban mask for the nick's host if it's known from a
+// tracked channel, and otherwise for the nick.
+func (c *Conn) banMask(nick string) string {
+	key := c.fold(nick)
+	for _, ch := range c.channels {
+		if member, ok := ch.Members[key]; ok && member.User.Host != "" {
+			return "*!*@" + member.User.Host
+		}
+	}
+	return firstWord(nick) + "!*@*"
+}
+
+// updateMembers replaces the member list of a tracked channel with the result
+// of a NAMES query, preserving any user details we already knew.
+func (c *Conn) updateMembers(name string, members []ChannelMember) {
+	ch := c.trackedChannel(name)
+	if ch == nil {
+		return
+	}
+	old := ch.Members
+	ch.Members = make(map[string]ChannelMember, len(members))
+	for _, member := range members {
+		key := c.fold(member.User.Nick)
+		if prev, ok := old[key]; ok && member.User.Host == "" {
+			member.User = prev.User
+		}
+		ch.Members[key] = member
+	}
+}
+
+func h_JOIN(conn *Conn, line Line) {
+	if len(line.Args) == 0 {
+		return
+	}
+	name := line.Args[0]
+	if conn.trackState {
+		conn.addMember(name, line)
+	}
+	if line.SrcIsMe() {
+		conn.dispatchReply(JOINRESULT, line, []string{name}, JoinResult{Channel: name})
+	}
+}
+
+// addMember adds the source of a JOIN to the tracked channel. If the source
+// is ourselves, the channel is tracked from now on.
+func (c *Conn) addMember(name string, line Line) {
+	ch := c.trackedChannel(name)
+	if line.SrcIsMe() {
+		if ch == nil {
+			ch = &Channel{Name: name, Members: make(map[string]ChannelMember)}
+			c.channels[c.fold(name)] = ch
+		}
+	} else if ch == nil {
+		return
+	}
+	ch.Members[c.fold(line.Src.Nick)] = ChannelMember{User: line.Src}
+}
+
+func h_PART(conn *Conn, line Line) {
+	if !conn.trackState || len(line.Args) == 0 {
+		return
+	}
+	for _, name := range strings.Split(line.Args[0], ",") {
+		conn.removeMember(name, line.Src.Nick)
+	}
+}
+
+func h_KICK(conn *Conn, line Line) {
+	// KICK <channel> <nick> [:<reason>]
+	if !conn.trackState || len(line.Args) < 2 {
+		return
+	}
+	conn.removeMember(line.Args[0], line.Args[1])
+}
+
+func h_QUIT(conn *Conn, line Line) {
+	// QUIT :<reason>
+	// During a netsplit, the QUITs may be in a netsplit batch, but each one is
+	// still dispatched as normal.
+	if !conn.trackState || line.SrcIsMe() {
+		return
+	}
+	key := conn.fold(line.Src.Nick)
+	for _, ch := range conn.channels {
+		delete(ch.Members, key)
+	}
+}
+
+// removeMember removes the nick from the tracked channel. If the nick is our
+// own, the channel is no longer tracked.
+func (c *Conn) removeMember(name, nick string) {
+	ch := c.trackedChannel(name)
+	if ch == nil {
+		return
+	}
+	if c.fold(nick) == c.fold(c.me.Nick) {
+		delete(c.channels, c.fold(name))
+	} else {
+		delete(ch.Members, c.fold(nick))
+	}
+}
+
+// renameMember updates every tracked channel after a nick change. The new
+// nick may fold to the same key as the old one, if only its case changed.
+func (c *Conn) renameMember(oldNick, newNick string) {
+	oldKey, newKey := c.fold(oldNick), c.fold(newNick)
+	for _, ch := range c.channels {
+		member, ok := ch.Members[oldKey]
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(member.User.Raw, member.User.Nick) {
+			member.User.Raw = newNick + member.User.Raw[len(member.User.Nick):]
+		}
+		member.User.Nick = newNick
+		// any existing member with the new nick must be stale, as the
+		// server allowed the change
+		delete(ch.Members, oldKey)
+		ch.Members[newKey] = member
+	}
+}
+
+// updateMemberModes applies the prefix mode changes, such as +o, to the
+// members of a tracked channel.
+func (c *Conn) updateMemberModes(name string, changes []ModeChange) {
+	ch := c.trackedChannel(name)
+	if ch == nil {
+		return
+	}
+	modes, symbols := c.prefixes()
+	for _, change := range changes {
+		key := c.fold(change.Arg)
+		member, ok := ch.Members[key]
+		if !ok || strings.IndexByte(modes, change.Mode) == -1 {
+			continue
+		}
+		// rebuild the modes in rank order
+		newModes, newPrefix := "", ""
+		for i := 0; i < len(modes); i++ {
+			has := member.HasMode(modes[i])
+			if modes[i] == change.Mode {
+				has = change.Add
+			}
+			if has {
+				newModes += modes[i : i+1]
+				newPrefix += symbols[i : i+1]
+			}
+		}
+		member.Modes, member.Prefix = newModes, newPrefix
+		ch.Members[key] = member
+	}
+}
+
+func h_CHGHOST(conn *Conn, line Line) {
+	// CHGHOST <new user> <new host>
+	if len(line.Args) < 2 {
+		return
+	}
+	if line.SrcIsMe() {
+		conn.me.User = line.Args[0]
+		conn.me.Host = line.Args[1]
+	}
+	// we may not share any channels with the user, in which case there's
+	// nothing to update
+	key := conn.fold(line.Src.Nick)
+	for _, ch := range conn.channels {
+		if member, ok := ch.Members[key]; ok {
+			member.User.User = line.Args[0]
+			member.User.Host = line.Args[1]
+			member.User.Raw = member.User.Nick + "!" + member.User.User + "@" + member.User.Host
+			ch.Members[key] = member
+		}
+	}
+}
+
+func h_SETNAME(conn *Conn, line Line) {
+	// SETNAME :<new real name>
+	if len(line.Args) < 1 {
+		return
+	}
+	if line.SrcIsMe() {
+		conn.me.RealName = line.Args[0]
+	}
+	key := conn.fold(line.Src.Nick)
+	for _, ch := range conn.channels {
+		if member, ok := ch.Members[key]; ok {
+			member.User.RealName = line.Args[0]
+			ch.Members[key] = member
+		}
+	}
+}
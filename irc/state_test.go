@@ -0,0 +1,77 @@
+package irc
+
+import "testing"
+
+func TestFoldCase(t *testing.T) {
+	tests := []struct {
+		name, casemapping, want string
+	}{
+		{"NiCk", "ascii", "nick"},
+		{"[]\\^", "ascii", "[]\\^"},
+		{"NiCk", "rfc1459", "nick"},
+		{"[]\\^", "rfc1459", "{}|~"},
+		{"{}|~", "rfc1459", "{}|~"},
+		{"_`", "rfc1459", "_`"},
+		{"[]\\^", "strict-rfc1459", "{}|^"},
+		{"{}|~", "strict-rfc1459", "{}|~"},
+		{"NiCk[]", "rfc7613", "nick[]"},
+		{"ÉTÉ", "rfc7613", "été"},
+		{"ÉTÉ", "ascii", "ÉtÉ"},
+	}
+	for _, test := range tests {
+		if got := FoldCase(test.name, test.casemapping); got != test.want {
+			t.Errorf("FoldCase(%q, %q) = %q, want %q", test.name, test.casemapping, got, test.want)
+		}
+	}
+}
+
+func TestSrcIsMe(t *testing.T) {
+	tests := []struct {
+		src, me, casemapping string
+		want                 bool
+	}{
+		{"Nick", "nick", "ascii", true},
+		{"nick[a]", "NICK{A}", "ascii", false},
+		{"nick[a]", "NICK{A}", "rfc1459", true},
+		{"nick\\", "NICK|", "rfc1459", true},
+		{"nick^", "NICK~", "rfc1459", true},
+		{"nick^", "NICK~", "strict-rfc1459", false},
+		{"nick[a]", "NICK{A}", "strict-rfc1459", true},
+		{"other", "nick", "rfc1459", false},
+	}
+	for _, test := range tests {
+		line := Line{Src: User{Nick: test.src}, me: User{Nick: test.me}, casemap: test.casemapping}
+		if got := line.SrcIsMe(); got != test.want {
+			t.Errorf("SrcIsMe() with %q and me %q under %q = %v, want %v", test.src, test.me, test.casemapping, got, test.want)
+		}
+	}
+}
+
+func TestNickChangeCaseMapping(t *testing.T) {
+	tests := []struct {
+		casemapping string
+		want        string
+	}{
+		{"", "new"}, // rfc1459 is the default
+		{"rfc1459", "new"},
+		{"strict-rfc1459", "new"},
+		{"ascii", "me|"},
+	}
+	for _, test := range tests {
+		t.Run(test.casemapping, func(t *testing.T) {
+			s := newTestServer(t, Config{Nick: "me|"})
+			s.expect("NICK :me|", "USER guest 8 * :guest")
+			s.send(":srv 001 me| :Welcome")
+			if test.casemapping != "" {
+				s.send(":srv 005 me| CASEMAPPING=" + test.casemapping + " :are supported by this server")
+			}
+			s.send(":ME\\!u@h NICK new")
+			s.sync()
+			nick := make(chan string, 1)
+			s.conn.Invoke(func(c *Conn) { nick <- c.Me().Nick })
+			if got := <-nick; got != test.want {
+				t.Errorf("Me().Nick = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package irc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats contains counters for the traffic on a connection.
+// Byte counts exclude the line terminators.
+type Stats struct {
+	LinesSent     int64
+	LinesReceived int64
+	BytesSent     int64
+	BytesReceived int64
+	// FloodDelays is the number of times flood protection delayed a line, and
+	// FloodDelay is the total time spent waiting. A growing FloodDelay means
+	// the connection is being throttled.
+	FloodDelays int64
+	FloodDelay  time.Duration
+	// Reconnects is the number of successful calls to SafeConn.Reconnect.
+	// The other counters include all connections.
+	Reconnects int64
+}
+
+// connStats is updated by connWriter and connReader as lines pass through.
+type connStats struct {
+	linesSent     atomic.Int64
+	linesReceived atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	floodDelays   atomic.Int64
+	floodDelay    atomic.Int64 // nanoseconds
+	reconnects    atomic.Int64
+}
+
+func (s *connStats) sent(line string) {
+	s.linesSent.Add(1)
+	s.bytesSent.Add(int64(len(line)))
+}
+
+func (s *connStats) received(line string) {
+	s.linesReceived.Add(1)
+	s.bytesReceived.Add(int64(len(line)))
+}
+
+func (s *connStats) delayed(d time.Duration) {
+	s.floodDelays.Add(1)
+	s.floodDelay.Add(int64(d))
+}
+
+func (s *connStats) snapshot() Stats {
+	return Stats{
+		LinesSent:     s.linesSent.Load(),
+		LinesReceived: s.linesReceived.Load(),
+		BytesSent:     s.bytesSent.Load(),
+		BytesReceived: s.bytesReceived.Load(),
+		FloodDelays:   s.floodDelays.Load(),
+		FloodDelay:    time.Duration(s.floodDelay.Load()),
+		Reconnects:    s.reconnects.Load(),
+	}
+}
+
+// Stats returns the traffic counters for the connection.
+func (c *Conn) Stats() Stats {
+	return c.safeConnState.stats.snapshot()
+}
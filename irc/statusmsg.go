@@ -0,0 +1,37 @@
+package irc
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrStatusPrefix is returned by PrivmsgStatus and NoticeStatus if the server
+// doesn't advertise the prefix in its STATUSMSG ISUPPORT token.
+var ErrStatusPrefix = errors.New("irc: status prefix not supported by server")
+
+// PrivmsgStatus sends a PRIVMSG to only the members of the channel with the
+// given status or higher, such as '@' for the ops, using the STATUSMSG
+// ISUPPORT token. Returns ErrStatusPrefix if the server doesn't support the
+// prefix.
+func (c *Conn) PrivmsgStatus(prefix byte, channel, msg string) error {
+	if !statusSupported(c.safeConnState.isupport, prefix) {
+		return ErrStatusPrefix
+	}
+	c.Privmsg(string(prefix)+channel, msg)
+	return nil
+}
+
+// NoticeStatus is like PrivmsgStatus, but sends a NOTICE.
+func (c *Conn) NoticeStatus(prefix byte, channel, msg string) error {
+	if !statusSupported(c.safeConnState.isupport, prefix) {
+		return ErrStatusPrefix
+	}
+	c.Notice(string(prefix)+channel, msg)
+	return nil
+}
+
+// statusSupported returns whether the prefix is in the STATUSMSG token of
+// isupport, which must not be modified while this runs.
+func statusSupported(isupport map[string]string, prefix byte) bool {
+	return strings.IndexByte(isupport["STATUSMSG"], prefix) != -1
+}
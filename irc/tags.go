@@ -0,0 +1,135 @@
+package irc
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrNoCapability is returned when a message needs a capability, such as
+// message-tags, that isn't enabled. Nothing is sent.
+var ErrNoCapability = errors.New("irc: capability not enabled")
+
+// PrivmsgTagged sends a PRIVMSG with IRCv3 client-only tags, such as
+// "+draft/reply". Names without the "+" prefix get one, and values are
+// escaped as necessary; an empty value sends the tag without one. Tags with
+// invalid names are skipped. Returns ErrNoCapability if there are tags but
+// the message-tags capability isn't enabled.
+func (c *Conn) PrivmsgTagged(dst, msg string, tags map[string]string) error {
+	prefix := composeTags(tags)
+	if prefix != "" && !c.HasCapability("message-tags") {
+		return ErrNoCapability
+	}
+	c.markActive()
+	c.send(prefix + composePrivmsg(dst, msg))
+	return nil
+}
+
+// The states of a typing notification. See Typing.
+const (
+	TypingActive = "active"
+	TypingPaused = "paused" // the user stopped typing, but didn't clear the text
+	TypingDone   = "done"   // the user cleared or sent the text
+)
+
+// Typing tells the target that we're typing, using a TAGMSG with the +typing
+// client tag. The state is TypingActive, TypingPaused, or TypingDone. While
+// typing, TypingActive should be sent at most every 3 seconds. Returns
+// ErrNoCapability if the message-tags capability isn't enabled.
+func (c *Conn) Typing(target, state string) error {
+	if !c.HasCapability("message-tags") {
+		return ErrNoCapability
+	}
+	c.send(composeTagMsg(target, map[string]string{"+typing": state}))
+	return nil
+}
+
+// Reaction is a reaction to a message, sent with React.
+type Reaction struct {
+	MsgID    string // the msgid of the message reacted to
+	Reaction string // such as an emoji
+}
+
+// Reaction returns the reaction for a REACTION line.
+// The second return value is false if the line isn't a REACTION event.
+func (l *Line) Reaction() (Reaction, bool) {
+	reaction, ok := l.data.(Reaction)
+	return reaction, ok
+}
+
+// React reacts to the message with the given msgid, as returned by
+// Line.MsgID(), such as with an emoji. It uses a TAGMSG with the
+// +draft/react and +draft/reply client tags. The target is where the message
+// was sent, as returned by Line.ReplyTarget().
+// Returns ErrNoCapability if the message-tags capability isn't enabled.
+func (c *Conn) React(target, msgid, reaction string) error {
+	if !c.HasCapability("message-tags") {
+		return ErrNoCapability
+	}
+	c.send(composeReact(target, msgid, reaction))
+	return nil
+}
+
+func h_TAGMSG(conn *Conn, line Line) {
+	// TAGMSG <target>
+	if len(line.Args) == 0 {
+		return
+	}
+	line.Dst = line.Args[0]
+	if state, ok := line.Tags["+typing"]; ok {
+		conn.dispatchReply(TYPING, line, []string{state}, nil)
+	}
+	if reaction, ok := line.Tags["+draft/react"]; ok {
+		if msgid := line.Tags["+draft/reply"]; msgid != "" {
+			conn.dispatchReply(REACTION, line, []string{reaction}, Reaction{MsgID: msgid, Reaction: reaction})
+		}
+	}
+}
+
+func composeReact(target, msgid, reaction string) string {
+	return composeTagMsg(target, map[string]string{"+draft/reply": msgid, "+draft/react": reaction})
+}
+
+func composeTagMsg(target string, tags map[string]string) string {
+	return composeTags(tags) + filterMessage("TAGMSG "+firstWord(target))
+}
+
+// composeTags returns the tags as the "@tag=value;... " prefix of a line,
+// sorted by name, or "" if there are none. Clients may only send client-only
+// tags, so names without the "+" prefix get one.
+func composeTags(tags map[string]string) string {
+	names := make([]string, 0, len(tags))
+	values := make(map[string]string, len(tags))
+	for name, val := range tags {
+		if name == "" || name == "+" || strings.ContainsAny(name, " ;=@\x00\r\n") {
+			continue
+		}
+		if name[0] != '+' {
+			name = "+" + name
+			if _, ok := tags[name]; ok {
+				// the prefixed name was given too, and takes precedence
+				continue
+			}
+		}
+		names = append(names, name)
+		values[name] = val
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('@')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(name)
+		if val := values[name]; val != "" {
+			b.WriteByte('=')
+			b.WriteString(escapeTag(val))
+		}
+	}
+	b.WriteByte(' ')
+	return b.String()
+}
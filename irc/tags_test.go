@@ -0,0 +1,103 @@
+package irc
+
+import "testing"
+
+func TestComposeTags(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want string
+	}{
+		{nil, ""},
+		{map[string]string{}, ""},
+		{map[string]string{"+draft/reply": "abc"}, "@+draft/reply=abc "},
+		{map[string]string{"draft/reply": "abc"}, "@+draft/reply=abc "},
+		{map[string]string{"+b": "", "+a": "x y;z"}, "@+a=x\\sy\\:z;+b "},
+		{map[string]string{"a": "plain", "+a": "prefixed"}, "@+a=prefixed "},
+		{map[string]string{"": "x", "+": "x", "bad name": "x", "a=b": "x"}, ""},
+	}
+	for _, test := range tests {
+		if got := composeTags(test.tags); got != test.want {
+			t.Errorf("composeTags(%q) = %q, want %q", test.tags, got, test.want)
+		}
+	}
+}
+
+// capSender has the methods, common to Conn and SafeConn, that need a
+// capability.
+type capSender interface {
+	PrivmsgTagged(dst, msg string, tags map[string]string) error
+	Typing(target, state string) error
+	React(target, msgid, reaction string) error
+	Delete(target, msgid, reason string) error
+}
+
+func TestCapabilityRequired(t *testing.T) {
+	tests := []struct {
+		name       string
+		capability string
+		send       func(capSender) error
+		want       string
+	}{
+		{
+			"PrivmsgTagged", "message-tags",
+			func(c capSender) error {
+				return c.PrivmsgTagged("#chan", "hi", map[string]string{"draft/reply": "abc"})
+			},
+			"@+draft/reply=abc PRIVMSG #chan :hi",
+		},
+		{
+			"Typing", "message-tags",
+			func(c capSender) error { return c.Typing("#chan", TypingDone) },
+			"@+typing=done TAGMSG #chan",
+		},
+		{
+			"React", "message-tags",
+			func(c capSender) error { return c.React("#chan", "abc", "👍") },
+			"@+draft/react=👍;+draft/reply=abc TAGMSG #chan",
+		},
+		{
+			"Delete", "draft/message-redaction",
+			func(c capSender) error { return c.Delete("#chan", "abc", "oops") },
+			"REDACT #chan abc :oops",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AllowFlood: true})
+			s.register()
+			if err := test.send(s.conn); err != ErrNoCapability {
+				t.Errorf("SafeConn without %s returned %v, want ErrNoCapability", test.capability, err)
+			}
+			errc := make(chan error, 1)
+			s.conn.Invoke(func(c *Conn) { errc <- test.send(c) })
+			if err := <-errc; err != ErrNoCapability {
+				t.Errorf("Conn without %s returned %v, want ErrNoCapability", test.capability, err)
+			}
+			if lines := s.sync(); len(lines) != 0 {
+				t.Errorf("unexpected lines %q", lines)
+			}
+
+			s = newTestServer(t, Config{AllowFlood: true, Capabilities: []string{test.capability}})
+			s.registerCaps(test.capability)
+			s.sync()
+			if err := test.send(s.conn); err != nil {
+				t.Errorf("SafeConn returned %v", err)
+			}
+			s.conn.Invoke(func(c *Conn) { errc <- test.send(c) })
+			if err := <-errc; err != nil {
+				t.Errorf("Conn returned %v", err)
+			}
+			s.expect(test.want, test.want)
+		})
+	}
+}
+
+func TestPrivmsgTaggedWithoutTags(t *testing.T) {
+	// no capability is needed without tags
+	s := newTestServer(t, Config{AllowFlood: true})
+	s.register()
+	if err := s.conn.PrivmsgTagged("#chan", "untagged", nil); err != nil {
+		t.Errorf("PrivmsgTagged with no tags returned %v", err)
+	}
+	s.expect("PRIVMSG #chan :untagged")
+}
@@ -0,0 +1,24 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// NewTestConn sets up a connection over an in-memory pipe instead of dialing
+// a server, for testing handlers. The returned net.Conn is the server end of
+// the pipe: lines written to it are processed as if sent by the server, and
+// lines sent by the client can be read from it.
+//
+// The Host, Port, SSL, StartTLS, and Timeout fields of the Config are ignored.
+// As the pipe is unbuffered, the client stops writing (but continues to
+// process incoming lines) until the server end is read from. Closing the
+// server end disconnects the client.
+func NewTestConn(config Config) (SafeConn, net.Conn, error) {
+	if config.Init == nil {
+		return nil, nil, errors.New("Config needs an Init function")
+	}
+	client, server := net.Pipe()
+	return startConn(context.Background(), client, "pipe", config, nil), server, nil
+}
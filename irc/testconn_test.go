@@ -0,0 +1,140 @@
+package irc
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer drives a connection made with NewTestConn.
+type testServer struct {
+	t    *testing.T
+	conn SafeConn
+	pipe net.Conn
+	rd   *bufio.Reader
+}
+
+func newTestServer(t *testing.T, config Config) *testServer {
+	t.Helper()
+	if config.Nick == "" {
+		config.Nick = "me"
+	}
+	if config.Init == nil {
+		config.Init = func(HandlerRegistry) {}
+	}
+	conn, pipe, err := NewTestConn(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pipe.Close() })
+	return &testServer{t: t, conn: conn, pipe: pipe, rd: bufio.NewReader(pipe)}
+}
+
+// send sends lines to the client as the server.
+func (s *testServer) send(lines ...string) {
+	s.t.Helper()
+	for _, line := range lines {
+		s.pipe.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := io.WriteString(s.pipe, line+"\r\n"); err != nil {
+			s.t.Fatalf("sending %q: %v", line, err)
+		}
+	}
+}
+
+// next returns the next line sent by the client.
+func (s *testServer) next() string {
+	s.t.Helper()
+	s.pipe.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		s.t.Fatalf("reading: %v", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// expect checks that the client sent exactly the given lines, in order.
+func (s *testServer) expect(lines ...string) {
+	s.t.Helper()
+	for _, want := range lines {
+		if got := s.next(); got != want {
+			s.t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+// register consumes the login lines and completes registration.
+func (s *testServer) register() {
+	s.t.Helper()
+	s.expect("NICK :me", "USER guest 8 * :guest")
+	s.send(":srv 001 me :Welcome")
+}
+
+// registerCaps is like register, but negotiates the given capabilities,
+// which must be the Config's.
+func (s *testServer) registerCaps(caps ...string) {
+	s.t.Helper()
+	list := strings.Join(caps, " ")
+	s.expect("CAP LS 302", "NICK :me", "USER guest 8 * :guest")
+	s.send(":srv CAP * LS :" + list)
+	s.expect("CAP REQ :" + list)
+	s.send(":srv CAP me ACK :" + list)
+	s.expect("CAP END")
+	s.send(":srv 001 me :Welcome")
+}
+
+// sync waits until the client has processed the lines sent so far, and
+// returns the lines it sent meanwhile.
+func (s *testServer) sync() []string {
+	s.t.Helper()
+	s.send("PING :sync")
+	var lines []string
+	for {
+		line := s.next()
+		if line == "PONG :sync" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestNewTestConn(t *testing.T) {
+	received := make(chan Line, 1)
+	s := newTestServer(t, Config{
+		User:       "user",
+		RealName:   "Real Name",
+		AllowFlood: true,
+		Init: func(hr HandlerRegistry) {
+			hr.AddHandler("PRIVMSG", func(c *Conn, line Line) {
+				received <- line
+				c.Notice(line.Src.Nick, "hello")
+			})
+		},
+	})
+	s.expect("NICK :me", "USER user 8 * :Real Name")
+	s.send(":srv 001 me :Welcome", ":bob!b@host PRIVMSG me :hi there")
+	s.expect("NOTICE bob :hello")
+	line := <-received
+	if line.Src.Nick != "bob" || len(line.Args) != 2 || line.Args[1] != "hi there" {
+		t.Errorf("handler got %#v", line)
+	}
+
+	if !s.conn.Privmsg("#chan", "from a SafeConn") {
+		t.Fatal("Privmsg failed on an open connection")
+	}
+	s.expect("PRIVMSG #chan :from a SafeConn")
+
+	disconnected := make(chan bool)
+	s.conn.AddHandler(DISCONNECTED, func(*Conn, Line) { close(disconnected) })
+	s.pipe.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("closing the server end didn't disconnect the client")
+	}
+	if s.conn.Connected() {
+		t.Error("Connected() is true after disconnecting")
+	}
+}